@@ -1,18 +1,31 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	ksm "github.com/keeper-security/secrets-manager-go/core"
 	"keepersecurity.com/ksm-scim/scim"
 	"log"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
 )
 
 func main() {
+	var planOnly = flag.Bool("plan", false, "print SCIM operations without executing them")
+	var exportPath = flag.String("export", "", "save SCIM operations to a plan file without executing them")
+	var applyPath = flag.String("apply", "", "execute SCIM operations from a plan file")
+	var statePath = flag.String("state", "", "keep the sync state in a local file instead of the SCIM record")
+	flag.Parse()
+
+	var ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	var err error
 	var filePath = "config.base64"
 	if _, err = os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
@@ -31,8 +44,8 @@ func main() {
 		Config: config,
 	})
 	var filter []string
-	if len(os.Args) == 2 {
-		filter = append(filter, os.Args[1])
+	if flag.NArg() == 1 {
+		filter = append(filter, flag.Arg(0))
 	}
 
 	var records []*ksm.Record
@@ -74,50 +87,103 @@ func main() {
 		return
 	}
 
-	var googleEndpoint = scim.NewGoogleEndpoint(gcp.Credentials, gcp.AdminAccount, gcp.ScimGroups)
+	var googleEndpoint = scim.NewGoogleEndpoint(gcp)
 
 	var sync = scim.NewScimSync(googleEndpoint, ka.Url, ka.Token)
 	sync.SetVerbose(ka.Verbose)
 	sync.SetDestructive(ka.Destructive)
+	sync.SetEmailRewrite(ka.EmailRewrite)
+	sync.SetTeamMapping(ka.TeamMapping)
+	sync.SetTeamNameTemplate(ka.TeamNameTemplate)
+	sync.SetRenameAliasMatches(ka.RenameAliasMatches)
+	sync.SetExclusions(ka.Exclusions)
+	sync.SetProtectedMarker(ka.ProtectedMarker)
+	sync.SetParallelism(ka.Parallelism)
+	sync.SetResume(ka.Resume)
+	sync.SetIncremental(ka.Incremental, ka.FullSyncInterval)
+	sync.SetGracePeriod(ka.GracePeriod)
+	if len(*statePath) > 0 {
+		sync.SetStateStore(scim.NewFileStateStore(*statePath))
+	} else if ka.GracePeriod > 0 || ka.Incremental || ka.Resume || ka.DeleteDeactivatedAfter > 0 {
+		sync.SetStateStore(scim.NewRecordStateStore(sm, scimRecord))
+	}
+	sync.SetDeprovision(ka.Deprovision)
+	sync.SetDeleteDeactivatedAfter(ka.DeleteDeactivatedAfter)
+	sync.SetDeletionLimit(ka.DeletionLimit, ka.DeletionLimitPercent)
+
+	if *planOnly || len(*exportPath) > 0 {
+		var plan *scim.SyncPlan
+		if plan, err = sync.Plan(ctx); err != nil {
+			log.Fatal(err.Error())
+		}
+		if len(*exportPath) > 0 {
+			var file *os.File
+			if file, err = os.Create(*exportPath); err != nil {
+				log.Fatal(err.Error())
+			}
+			if err = sync.ExportPlan(plan, file); err != nil {
+				log.Fatal(err.Error())
+			}
+			if err = file.Close(); err != nil {
+				log.Fatal(err.Error())
+			}
+			fmt.Printf("SCIM plan with %d operation(s) saved to \"%s\"\n", len(plan.Operations), *exportPath)
+		}
+		if *planOnly {
+			printPlan(plan)
+		}
+		return
+	}
 
 	var syncStat *scim.SyncStat
-	if syncStat, err = sync.Sync(); err != nil {
+	if len(*applyPath) > 0 {
+		var file *os.File
+		if file, err = os.Open(*applyPath); err != nil {
+			log.Fatal(err.Error())
+		}
+		var plan *scim.SyncPlan
+		plan, err = sync.ImportPlan(file)
+		_ = file.Close()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		syncStat, err = sync.Apply(ctx, plan)
+	} else {
+		syncStat, err = sync.Sync(ctx)
+	}
+	if syncStat != nil {
+		syncStat.Write(os.Stdout)
+	}
+	if err != nil {
 		log.Fatal(err.Error())
 	}
-	if len(syncStat.SuccessGroups) > 0 {
-		fmt.Printf("Group Success:\n")
-		for _, txt := range syncStat.SuccessGroups {
-			fmt.Printf("\t%s\n", txt)
-		}
+}
+
+func printPlan(plan *scim.SyncPlan) {
+	for _, warning := range plan.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
 	}
-	if len(syncStat.FailedGroups) > 0 {
-		fmt.Printf("Group Failure:\n")
-		for _, txt := range syncStat.FailedGroups {
-			fmt.Printf("\t%s\n", txt)
-		}
+	if len(plan.Operations) == 0 {
+		fmt.Printf("SCIM is in sync. No operations are planned\n")
+		return
 	}
-	if len(syncStat.SuccessUsers) > 0 {
-		fmt.Printf("User Success:\n")
-		for _, txt := range syncStat.SuccessUsers {
-			fmt.Printf("\t%s\n", txt)
+	for _, op := range plan.Operations {
+		var keeperId = op.KeeperId
+		if len(keeperId) == 0 {
+			keeperId = "-"
 		}
-	}
-	if len(syncStat.FailedUsers) > 0 {
-		fmt.Printf("User Failure:\n")
-		for _, txt := range syncStat.FailedUsers {
-			fmt.Printf("\t%s\n", txt)
+		if len(op.SkipReason) > 0 {
+			fmt.Printf("SKIP %s %s \"%s\" (%s): %s\n", op.Method, op.ResourceType, op.Name, keeperId, op.SkipReason)
+			continue
 		}
-	}
-	if len(syncStat.SuccessMembership) > 0 {
-		fmt.Printf("Membership Success:\n")
-		for _, txt := range syncStat.SuccessMembership {
-			fmt.Printf("\t%s\n", txt)
+		fmt.Printf("%s %s \"%s\" (%s)\n", op.Method, op.ResourceType, op.Name, keeperId)
+		if len(op.Note) > 0 {
+			fmt.Printf("\t%s\n", op.Note)
 		}
-	}
-	if len(syncStat.FailedMembership) > 0 {
-		fmt.Printf("Membership Failure:\n")
-		for _, txt := range syncStat.FailedMembership {
-			fmt.Printf("\t%s\n", txt)
+		if op.Payload != nil {
+			if data, err := json.MarshalIndent(op.Payload, "\t", "  "); err == nil {
+				fmt.Printf("\t%s\n", string(data))
+			}
 		}
 	}
 }
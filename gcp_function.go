@@ -7,13 +7,13 @@ import (
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
 	ksm "github.com/keeper-security/secrets-manager-go/core"
-	"io"
 	"keepersecurity.com/ksm-scim/scim"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -24,8 +24,9 @@ func init() {
 
 const ksmConfigName = "KSM_CONFIG_BASE64"
 const ksmRecordUid = "KSM_RECORD_UID"
+const scimSyncTimeout = "SCIM_SYNC_TIMEOUT"
 
-func runScimSync() (syncStat *scim.SyncStat, err error) {
+func runScimSync(ctx context.Context) (syncStat *scim.SyncStat, err error) {
 	var configBase64 = os.Getenv(ksmConfigName)
 	if len(configBase64) == 0 {
 		err = errors.New(fmt.Sprintf("Environment variable \"%s\" is not set", ksmConfigName))
@@ -33,6 +34,19 @@ func runScimSync() (syncStat *scim.SyncStat, err error) {
 		return
 	}
 
+	var syncTimeout = os.Getenv(scimSyncTimeout)
+	if len(syncTimeout) > 0 {
+		var timeout time.Duration
+		if timeout, err = time.ParseDuration(syncTimeout); err != nil {
+			err = fmt.Errorf("Environment variable \"%s\": %s", scimSyncTimeout, err.Error())
+			log.Println(err)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	var config = ksm.NewMemoryKeyValueStorage(configBase64)
 	var sm = ksm.NewSecretsManager(&ksm.ClientOptions{
 		Config: config,
@@ -87,71 +101,48 @@ func runScimSync() (syncStat *scim.SyncStat, err error) {
 		log.Println(err)
 		return
 	}
-	var googleEndpoint = scim.NewGoogleEndpoint(gcp.Credentials, gcp.AdminAccount, gcp.ScimGroups)
+	var googleEndpoint = scim.NewGoogleEndpoint(gcp)
 	var sync = scim.NewScimSync(googleEndpoint, ka.Url, ka.Token)
 	sync.SetVerbose(ka.Verbose)
 	sync.SetDestructive(ka.Destructive)
-
-	if syncStat, err = sync.Sync(); err == nil {
-		printStatistics(os.Stdout, syncStat)
+	sync.SetEmailRewrite(ka.EmailRewrite)
+	sync.SetTeamMapping(ka.TeamMapping)
+	sync.SetTeamNameTemplate(ka.TeamNameTemplate)
+	sync.SetRenameAliasMatches(ka.RenameAliasMatches)
+	sync.SetExclusions(ka.Exclusions)
+	sync.SetProtectedMarker(ka.ProtectedMarker)
+	sync.SetParallelism(ka.Parallelism)
+	sync.SetResume(ka.Resume)
+	sync.SetIncremental(ka.Incremental, ka.FullSyncInterval)
+	sync.SetGracePeriod(ka.GracePeriod)
+	if ka.GracePeriod > 0 || ka.Incremental || ka.Resume || ka.DeleteDeactivatedAfter > 0 {
+		sync.SetStateStore(scim.NewRecordStateStore(sm, scimRecord))
 	}
+	sync.SetDeprovision(ka.Deprovision)
+	sync.SetDeleteDeactivatedAfter(ka.DeleteDeactivatedAfter)
+	sync.SetDeletionLimit(ka.DeletionLimit, ka.DeletionLimitPercent)
 
-	return
-}
-
-func printStatistics(w io.Writer, syncStat *scim.SyncStat) {
+	syncStat, err = sync.Sync(ctx)
 	if syncStat != nil {
-		if len(syncStat.SuccessGroups) > 0 {
-			_, _ = fmt.Fprintf(w, "Group Success:\n")
-			for _, txt := range syncStat.SuccessGroups {
-				_, _ = fmt.Fprintf(w, "\t%s\n", txt)
-			}
-		}
-		if len(syncStat.FailedGroups) > 0 {
-			_, _ = fmt.Fprintf(w, "Group Failure:\n")
-			for _, txt := range syncStat.FailedGroups {
-				_, _ = fmt.Fprintf(w, "\t%s\n", txt)
-			}
-		}
-		if len(syncStat.SuccessUsers) > 0 {
-			_, _ = fmt.Fprintf(w, "User Success:\n")
-			for _, txt := range syncStat.SuccessUsers {
-				_, _ = fmt.Fprintf(w, "\t%s\n", txt)
-			}
-		}
-		if len(syncStat.FailedUsers) > 0 {
-			_, _ = fmt.Fprintf(w, "User Failure:\n")
-			for _, txt := range syncStat.FailedUsers {
-				_, _ = fmt.Fprintf(w, "\t%s\n", txt)
-			}
-		}
-		if len(syncStat.SuccessMembership) > 0 {
-			_, _ = fmt.Fprintf(w, "Membership Success:\n")
-			for _, txt := range syncStat.SuccessMembership {
-				_, _ = fmt.Fprintf(w, "\t%s\n", txt)
-			}
-		}
-		if len(syncStat.FailedMembership) > 0 {
-			_, _ = fmt.Fprintf(w, "Membership Failure:\n")
-			for _, txt := range syncStat.FailedMembership {
-				_, _ = fmt.Fprintf(w, "\t%s\n", txt)
-			}
-		}
+		syncStat.Write(os.Stdout)
 	}
+
+	return
 }
 
 // Function gcpScimSync is an HTTP handler
 func gcpScimSyncHttp(w http.ResponseWriter, r *http.Request) {
-	var syncStat, err = runScimSync()
-	if err == nil {
-		printStatistics(w, syncStat)
-	} else {
+	var syncStat, err = runScimSync(r.Context())
+	if syncStat != nil {
+		syncStat.Write(w)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 // helloPubSub consumes a CloudEvent message and extracts the Pub/Sub message.
-func gcpScimSyncPubSub(_ context.Context, _ event.Event) (err error) {
-	_, err = runScimSync()
+func gcpScimSyncPubSub(ctx context.Context, _ event.Event) (err error) {
+	_, err = runScimSync(ctx)
 	return
 }
@@ -0,0 +1,76 @@
+package scim
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Exclusion is a "SCIM Exclude" entry: an email, a group or team name, or a pattern with "*" and "?" wildcards
+type Exclusion struct {
+	Entry string
+	regex *regexp.Regexp
+}
+
+// ParseExclusions parses the "SCIM Exclude" content. Entries are separated by new lines or commas
+func ParseExclusions(value string) (exclusions []*Exclusion, err error) {
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if len(entry) == 0 {
+				continue
+			}
+			var exclusion = &Exclusion{
+				Entry: entry,
+			}
+			if strings.ContainsAny(entry, "*?") {
+				var pattern = regexp.QuoteMeta(entry)
+				pattern = strings.ReplaceAll(pattern, "\\*", ".*")
+				pattern = strings.ReplaceAll(pattern, "\\?", ".")
+				if exclusion.regex, err = regexp.Compile("(?i)^" + pattern + "$"); err != nil {
+					err = fmt.Errorf("invalid exclusion pattern \"%s\": %s", entry, err.Error())
+					return
+				}
+			}
+			exclusions = append(exclusions, exclusion)
+		}
+	}
+	return
+}
+
+// Matches checks if an email or a name is covered by the exclusion
+func (e *Exclusion) Matches(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	if e.regex != nil {
+		return e.regex.MatchString(value)
+	}
+	return strings.EqualFold(e.Entry, value)
+}
+
+// excludedResource is a Google user or group dropped from the SCIM scope
+type excludedResource struct {
+	name  string
+	entry string
+}
+
+// exclusionOf returns the "SCIM Exclude" entry that covers any of the values
+func (s *sync) exclusionOf(values ...string) string {
+	for _, e := range s.exclusions {
+		for _, value := range values {
+			if e.Matches(value) {
+				return e.Entry
+			}
+		}
+	}
+	return ""
+}
+
+func exclusionReason(entry string) string {
+	return fmt.Sprintf("excluded by \"SCIM Exclude\" entry \"%s\"", entry)
+}
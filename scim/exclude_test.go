@@ -0,0 +1,90 @@
+package scim
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExclusions(t *testing.T) {
+	var exclusions, err = ParseExclusions(`
+# comment
+ceo@company.com, Board
+svc-*@company.com
+team-?
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for _, exclusion := range exclusions {
+		entries = append(entries, exclusion.Entry)
+	}
+	if expected := []string{"ceo@company.com", "Board", "svc-*@company.com", "team-?"}; !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("entries: %v", entries)
+	}
+	var s = &sync{exclusions: exclusions}
+	var tests = []struct {
+		value    string
+		expected string
+	}{
+		{value: "CEO@company.com", expected: "ceo@company.com"},
+		{value: "board", expected: "Board"},
+		{value: "Board Members", expected: ""},
+		{value: "svc-backup@company.com", expected: "svc-*@company.com"},
+		{value: "svc-backup@company.com.evil", expected: ""},
+		{value: "Team-A", expected: "team-?"},
+		{value: "team-ab", expected: ""},
+		{value: "", expected: ""},
+	}
+	for _, tt := range tests {
+		if actual := s.exclusionOf(tt.value); actual != tt.expected {
+			t.Errorf("\"%s\": \"%s\", expected \"%s\"", tt.value, actual, tt.expected)
+		}
+	}
+}
+
+func TestPlanExclusions(t *testing.T) {
+	var exclusions, _ = ParseExclusions("ceo@company.com, svc-*@company.com, Board")
+	var source = &testSource{
+		groups: []*Group{
+			{Id: "g1", Name: "Board", Email: "board@company.com"},
+			{Id: "g2", Name: "Sales", Email: "sales@company.com"},
+		},
+		users: []*User{
+			{Id: "u1", Email: "ceo@company.com", FullName: "CEO", Active: true, Groups: []string{"g2"}},
+			{Id: "u2", Email: "alice@company.com", FullName: "alice@company.com", Active: true, Groups: []string{"g1"}},
+			{Id: "u3", Email: "bob@company.com", FullName: "Bob", Active: true},
+		},
+	}
+	var s = newTestSync(t, source, newTestScim([]map[string]any{
+		scimUserObject("k1", "ceo@company.com", "u1"),
+		scimUserObject("k2", "alice@company.com", "u2", "t1"),
+		scimUserObject("k4", "svc-backup@company.com", ""),
+	}, []map[string]any{
+		scimGroupObject("t1", "Board", "g1"),
+	}))
+	s.SetExclusions(exclusions)
+	s.SetDestructive(1)
+	s.buildTeams()
+	var plan = new(SyncPlan)
+	if err := s.planGroups(plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.planUsers(plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.planMembership(plan); err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{
+		"update PATCH t1 (skipped)",
+		"create POST " + PendingKeeperId(GroupsResource, "g2"),
+		"update PATCH k1 (skipped)",
+		"delete DELETE k4 (skipped)",
+		"create POST " + PendingKeeperId(UsersResource, "u3"),
+	}
+	if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("operations:\n%s\nexpected:\n%s", strings.Join(actual, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -11,25 +11,69 @@ import (
 	"strings"
 )
 
+// NestedGroupMode controls how members of Google groups nested into SCIM groups are handled
+type NestedGroupMode string
+
+const (
+	// FlattenNestedGroups credits all transitive members to the top-level SCIM group
+	FlattenNestedGroups NestedGroupMode = "flatten"
+	// MirrorNestedGroups turns every nested group into a Keeper team of its own
+	MirrorNestedGroups NestedGroupMode = "mirror"
+	// DirectNestedGroups ignores members of nested groups
+	DirectNestedGroups NestedGroupMode = "direct"
+)
+
+// ParseNestedGroupMode parses the "Nested Groups" content
+func ParseNestedGroupMode(value string) (mode NestedGroupMode, err error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "flatten":
+		mode = FlattenNestedGroups
+	case "mirror":
+		mode = MirrorNestedGroups
+	case "direct", "direct-only":
+		mode = DirectNestedGroups
+	default:
+		err = fmt.Errorf("invalid nested group mode \"%s\": supported modes are \"flatten\", \"mirror\" and \"direct-only\"", value)
+	}
+	return
+}
+
 type googleEndpoint struct {
 	users          map[string]*User
 	groups         map[string]*Group
 	jwtCredentials []byte
 	subject        string
 	scimGroups     []string
+	orgUnits       []string
+	queries        []*UserQuery
+	mapping        []*AttributeMapping
+	nestedGroups   NestedGroupMode
+	maxDepth       int
+	protected      string
+	protectedUsers []*User
 	logger         SyncDebugLogger
 	loadErrors     bool
+	warnings       []string
 }
 
 // NewGoogleEndpoint creates an ICrmDataSource for accessing Users and Groups in Google Workspace
-// credentials: GCP service account JWT credentials
-// subject: Google Workspace admin account
-// scimGroup: Google Workspace Group that
-func NewGoogleEndpoint(credentials []byte, subject string, scimGroups []string) ICrmDataSource {
+// parameters: GCP service account JWT credentials, Google Workspace admin account, SCIM groups and organizational units,
+// user queries, Google user fields to SCIM attributes mapping, nested group handling and the protected user attribute
+func NewGoogleEndpoint(parameters *GoogleEndpointParameters) ICrmDataSource {
+	var nestedGroups = parameters.NestedGroups
+	if len(nestedGroups) == 0 {
+		nestedGroups = FlattenNestedGroups
+	}
 	return &googleEndpoint{
-		jwtCredentials: credentials,
-		subject:        subject,
-		scimGroups:     scimGroups,
+		jwtCredentials: parameters.Credentials,
+		subject:        parameters.AdminAccount,
+		scimGroups:     parameters.ScimGroups,
+		orgUnits:       parameters.OrgUnits,
+		queries:        parameters.Queries,
+		mapping:        withEnterpriseMapping(parameters.AttributeMapping),
+		nestedGroups:   nestedGroups,
+		maxDepth:       parameters.NestedGroupDepth,
+		protected:      parameters.ProtectedAttribute,
 	}
 }
 func (ge *googleEndpoint) DebugLogger() SyncDebugLogger {
@@ -48,6 +92,14 @@ func (ge *googleEndpoint) SetDebugLogger(logger SyncDebugLogger) {
 func (ge *googleEndpoint) LoadErrors() bool {
 	return ge.loadErrors
 }
+func (ge *googleEndpoint) Warnings() []string {
+	return ge.warnings
+}
+func (ge *googleEndpoint) ProtectedUsers(cb func(*User)) {
+	for _, v := range ge.protectedUsers {
+		cb(v)
+	}
+}
 func (ge *googleEndpoint) Users(cb func(*User)) {
 	if ge.users != nil {
 		for _, v := range ge.users {
@@ -79,25 +131,67 @@ func parseGoogleUser(gu *admin.User) (su *User) {
 			su.FullName = strings.TrimSpace(strings.Join([]string{gu.Name.GivenName, gu.Name.FamilyName}, " "))
 		}
 	}
+	var emails = NewSet[string]()
+	emails.Add(strings.ToLower(gu.PrimaryEmail))
+	var addAlias = func(email string) {
+		email = strings.TrimSpace(email)
+		if len(email) > 0 && !emails.Has(strings.ToLower(email)) {
+			emails.Add(strings.ToLower(email))
+			su.Aliases = append(su.Aliases, email)
+		}
+	}
+	for _, alias := range gu.Aliases {
+		addAlias(alias)
+	}
+	// only work addresses and addresses in the primary email domain identify the user. Home and other addresses are ignored
+	var domain = ""
+	if pos := strings.LastIndex(gu.PrimaryEmail, "@"); pos >= 0 {
+		domain = strings.ToLower(gu.PrimaryEmail[pos:])
+	}
+	if ea, ok := gu.Emails.([]any); ok {
+		for _, e := range ea {
+			if eo, ok := e.(map[string]any); ok {
+				if address, ok := toString(eo["address"]); ok {
+					var addressType, _ = toString(eo["type"])
+					if addressType == "work" || (len(domain) > 0 && strings.HasSuffix(strings.ToLower(address), domain)) {
+						addAlias(address)
+					}
+				}
+			}
+		}
+	}
 	return
 }
 
-func (ge *googleEndpoint) Populate() (err error) {
-	ge.loadErrors = false
-	params := google.CredentialsParams{
-		Scopes: []string{admin.AdminDirectoryUserReadonlyScope,
-			admin.AdminDirectoryGroupReadonlyScope, admin.AdminDirectoryGroupMemberReadonlyScope},
-		Subject: ge.subject,
+func (ge *googleEndpoint) parseUser(gu *admin.User) (su *User) {
+	su = parseGoogleUser(gu)
+	mapUserAttributes(su, gu, ge.mapping, ge.DebugLogger())
+	if len(ge.protected) > 0 {
+		su.Protected = isProtectedGoogleUser(su, gu, ge.protected, ge.DebugLogger())
 	}
-	var ctx = context.Background()
-	cred, _ := google.CredentialsFromJSONWithParams(ctx, ge.jwtCredentials, params)
-	var directory *admin.Service
-	if directory, err = admin.NewService(ctx, option.WithCredentials(cred)); err != nil {
-		return
+	return
+}
+
+// projection returns "full" if the attribute mapping refers to custom schemas
+func (ge *googleEndpoint) projection() string {
+	for _, am := range ge.mapping {
+		if strings.HasPrefix(am.Source, "customSchemas") {
+			return "full"
+		}
+	}
+	if strings.HasPrefix(ge.protected, "customSchemas") {
+		return "full"
 	}
+	return "basic"
+}
+
+func (ge *googleEndpoint) Populate(ctx context.Context) (err error) {
+	ge.loadErrors = false
+	ge.warnings = nil
+	ge.protectedUsers = nil
 
 	var scimGroups = NewSet[string]()
-	for _, x := range ge.scimGroups {
+	for _, x := range append(append([]string(nil), ge.scimGroups...), ge.orgUnits...) {
 		x = strings.TrimSpace(x)
 		if len(x) == 0 {
 			continue
@@ -116,35 +210,81 @@ func (ge *googleEndpoint) Populate() (err error) {
 			}
 		}
 	}
-	if len(scimGroups) == 0 {
+	if len(scimGroups) == 0 && !hasIncludeQueries(ge.queries) {
 		err = errors.New("could not resolve \"SCIM Group\" content to groups")
 		return
 	}
 
+	var scopes = []string{admin.AdminDirectoryUserReadonlyScope,
+		admin.AdminDirectoryGroupReadonlyScope, admin.AdminDirectoryGroupMemberReadonlyScope}
+	for entry := range scimGroups {
+		if isOrgUnitEntry(entry) {
+			scopes = append(scopes, admin.AdminDirectoryOrgunitReadonlyScope)
+			break
+		}
+	}
+	params := google.CredentialsParams{
+		Scopes:  scopes,
+		Subject: ge.subject,
+	}
+	cred, _ := google.CredentialsFromJSONWithParams(ctx, ge.jwtCredentials, params)
+	var directory *admin.Service
+	if directory, err = admin.NewService(ctx, option.WithCredentials(cred)); err != nil {
+		return
+	}
+
 	ge.users = make(map[string]*User)
 	ge.groups = make(map[string]*Group)
+	var orgUnits = make(map[string]*orgUnitScope)
 
 	ge.DebugLogger()("Resolving \"SCIM Group\" content")
 	var users *admin.Users
 	var groups *admin.Groups
 	for entry := range scimGroups {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if isOrgUnitEntry(entry) {
+			var scope *orgUnitScope
+			if scope, err = parseOrgUnitEntry(entry); err != nil {
+				ge.DebugLogger()(err.Error())
+				ge.loadErrors = true
+				continue
+			}
+			var ou *admin.OrgUnit
+			if ou, err = directory.Orgunits.Get("my_customer", strings.TrimPrefix(scope.path, "/")).Context(ctx).Do(); err == nil {
+				ge.DebugLogger()(fmt.Sprintf("Found Google organizational unit \"%s\"", ou.OrgUnitPath))
+				scope.path = ou.OrgUnitPath
+				orgUnits[ou.OrgUnitId] = scope
+				// the path keeps teams of organizational units with the same name apart
+				ge.groups[ou.OrgUnitId] = &Group{
+					Id:   ou.OrgUnitId,
+					Name: ou.OrgUnitPath,
+				}
+			} else {
+				ge.DebugLogger()(fmt.Sprintf("A path \"%s\" could not be resolved to Google organizational unit", scope.path))
+				ge.loadErrors = true
+			}
+			continue
+		}
 		var address *mail.Address
 		if address, err = mail.ParseAddress(entry); err == nil {
 			var gl = directory.Groups.List().Customer("my_customer").Query(fmt.Sprintf("email=%s", address.Address))
-			if groups, err = gl.Do(); err == nil && len(groups.Groups) > 0 {
+			if groups, err = gl.Context(ctx).Do(); err == nil && len(groups.Groups) > 0 {
 				for _, g := range groups.Groups {
 					ge.DebugLogger()(fmt.Sprintf("Found Google group \"%s\" for email \"%s\"", g.Name, g.Email))
 					ge.groups[g.Id] = &Group{
-						Id:   g.Id,
-						Name: g.Name,
+						Id:    g.Id,
+						Name:  g.Name,
+						Email: g.Email,
 					}
 				}
 			} else {
-				var ul = directory.Users.List().Customer("my_customer").Query(fmt.Sprintf("email=%s", address.Address))
-				if users, err = ul.Do(); err == nil && len(users.Users) > 0 {
+				var ul = directory.Users.List().Customer("my_customer").Projection(ge.projection()).Query(fmt.Sprintf("email=%s", address.Address))
+				if users, err = ul.Context(ctx).Do(); err == nil && len(users.Users) > 0 {
 					for _, u := range users.Users {
 						ge.DebugLogger()(fmt.Sprintf("Found Google user for email \"%s\"", u.PrimaryEmail))
-						var su = parseGoogleUser(u)
+						var su = ge.parseUser(u)
 						ge.users[su.Id] = su
 					}
 				} else {
@@ -154,12 +294,13 @@ func (ge *googleEndpoint) Populate() (err error) {
 			}
 		} else {
 			var gl = directory.Groups.List().Customer("my_customer").Query(fmt.Sprintf("name='%s'", entry))
-			if groups, err = gl.Do(); err == nil && len(groups.Groups) > 0 {
+			if groups, err = gl.Context(ctx).Do(); err == nil && len(groups.Groups) > 0 {
 				for _, g := range groups.Groups {
 					ge.DebugLogger()(fmt.Sprintf("Found Google group \"%s\" by name", g.Name))
 					ge.groups[g.Id] = &Group{
-						Id:   g.Id,
-						Name: g.Name,
+						Id:    g.Id,
+						Name:  g.Name,
+						Email: g.Email,
 					}
 				}
 			} else {
@@ -169,67 +310,217 @@ func (ge *googleEndpoint) Populate() (err error) {
 		}
 	}
 
-	if len(ge.groups) == 0 && len(ge.users) == 0 {
+	if len(ge.groups) == 0 && len(ge.users) == 0 && !hasIncludeQueries(ge.queries) {
 		err = errors.New("no Google Workspace groups could be resolved")
 		return
 	}
 
 	ge.DebugLogger()("Loading all users")
 	var userLookup = make(map[string]*User)
-	if err = directory.Users.List().Customer("my_customer").MaxResults(200).Pages(ctx, func(users *admin.Users) error {
+	var userOrgUnits = make(map[string]string)
+	if err = directory.Users.List().Customer("my_customer").Projection(ge.projection()).MaxResults(200).Pages(ctx, func(users *admin.Users) error {
 		var no = 0
 		for _, u := range users.Users {
-			var su = parseGoogleUser(u)
+			var su = ge.parseUser(u)
 			userLookup[su.Id] = su
+			userOrgUnits[su.Id] = u.OrgUnitPath
 			no++
 		}
 		ge.DebugLogger()(fmt.Sprintf("User page contains %d element(s)", no))
 		return nil
 	}); err != nil {
-		err = errors.New("google directory API: error querying users")
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else {
+			err = errors.New("google directory API: error querying users")
+		}
 		return
 	}
 	ge.DebugLogger()(fmt.Sprintf("Total %d Google user(s) loaded", len(userLookup)))
 
+	// organizational unit members
+	if len(orgUnits) > 0 {
+		var orgUnitIds = sortedKeys(orgUnits)
+		for _, userId := range sortedKeys(userLookup) {
+			var u = userLookup[userId]
+			for _, orgUnitId := range orgUnitIds {
+				if orgUnits[orgUnitId].contains(userOrgUnits[userId]) {
+					u.Groups = append(u.Groups, orgUnitId)
+					ge.users[u.Id] = u
+				}
+			}
+		}
+	}
+
 	var ok bool
 	// expand embedded groups
-	var membershipCache = make(map[string][]string)
+	var membershipCache = make(map[string][]*admin.Member)
+	var groupEmails = make(map[string]string)
 	for groupId, group := range ge.groups {
+		groupEmails[groupId] = group.Email
+	}
+	var cycles = NewSet[string]()
+	for _, groupId := range sortedKeys(ge.groups) {
+		if _, ok = orgUnits[groupId]; ok {
+			continue
+		}
 		var groupIds = []string{groupId}
-		var queuedIds = MakeSet[string](groupIds)
+		var parents = map[string]string{groupId: ""}
+		var depths = map[string]int{groupId: 0}
 		var pos = 0
 		for pos < len(groupIds) {
 			var gId = groupIds[pos]
 			pos++
 
-			var memberIds []string
-			if memberIds, ok = membershipCache[gId]; !ok {
-				if err = directory.Members.List(gId).Pages(ctx, func(members *admin.Members) error {
-					for _, m := range members.Members {
-						memberIds = append(memberIds, m.Id)
-					}
+			var members []*admin.Member
+			if members, ok = membershipCache[gId]; !ok {
+				if err = directory.Members.List(gId).Pages(ctx, func(page *admin.Members) error {
+					members = append(members, page.Members...)
 					return nil
 				}); err != nil {
-					ge.DebugLogger()(fmt.Sprintf("Loaded group \"%s\" membership failed: %s", group.Name, err.Error()))
+					if ctx.Err() != nil {
+						err = ctx.Err()
+						return
+					}
+					var message = fmt.Sprintf("Loading group \"%s\" membership failed: %s", groupEmails[gId], err.Error())
+					ge.DebugLogger()(message)
+					ge.warnings = append(ge.warnings, message)
+					ge.loadErrors = true
+					err = nil
 				}
-				membershipCache[gId] = memberIds
+				membershipCache[gId] = members
 			}
-			for _, mId := range memberIds {
+			for _, m := range members {
 				var u *User
-				if u, ok = userLookup[mId]; ok {
-					u.Groups = append(u.Groups, groupId)
+				if u, ok = userLookup[m.Id]; ok {
+					if ge.nestedGroups == MirrorNestedGroups {
+						u.Groups = append(u.Groups, gId)
+					} else {
+						u.Groups = append(u.Groups, groupId)
+					}
 					if _, ok = ge.users[u.Id]; !ok {
 						ge.users[u.Id] = u
 					}
-				} else {
-					if !queuedIds.Has(mId) {
-						groupIds = append(groupIds, mId)
-						queuedIds.Add(mId)
+					continue
+				}
+				if m.Type != "GROUP" {
+					continue
+				}
+				if len(m.Email) > 0 {
+					groupEmails[m.Id] = m.Email
+				}
+				if _, ok = parents[m.Id]; ok {
+					if cycle := nestedGroupCycle(parents, gId, m.Id, groupEmails); len(cycle) > 0 && !cycles.Has(cycle) {
+						cycles.Add(cycle)
+						ge.DebugLogger()(fmt.Sprintf("Nested group cycle is detected: %s", cycle))
+						ge.warnings = append(ge.warnings, fmt.Sprintf("Google group cycle: %s", cycle))
+					}
+					continue
+				}
+				if ge.nestedGroups == DirectNestedGroups {
+					ge.DebugLogger()(fmt.Sprintf("Members of nested group \"%s\" are ignored", groupEmails[m.Id]))
+					continue
+				}
+				if ge.maxDepth > 0 && depths[gId] >= ge.maxDepth {
+					ge.DebugLogger()(fmt.Sprintf("Nested group \"%s\" exceeds the maximum depth %d", groupEmails[m.Id], ge.maxDepth))
+					continue
+				}
+				parents[m.Id] = gId
+				depths[m.Id] = depths[gId] + 1
+				groupIds = append(groupIds, m.Id)
+				if ge.nestedGroups == MirrorNestedGroups {
+					if _, ok = ge.groups[m.Id]; !ok {
+						var nested = &Group{
+							Id:    m.Id,
+							Name:  m.Email,
+							Email: m.Email,
+						}
+						if g, er1 := directory.Groups.Get(m.Id).Context(ctx).Do(); er1 == nil {
+							nested.Name = g.Name
+						} else {
+							ge.DebugLogger()(fmt.Sprintf("Nested group \"%s\" could not be loaded: %s", m.Email, er1.Error()))
+						}
+						ge.groups[m.Id] = nested
 					}
 				}
 			}
 		}
 	}
 
+	if len(ge.queries) > 0 {
+		if err = ge.applyUserQueries(ctx, directory, userLookup); err != nil {
+			return
+		}
+	}
+
+	for _, userId := range sortedKeys(userLookup) {
+		if userLookup[userId].Protected {
+			ge.protectedUsers = append(ge.protectedUsers, userLookup[userId])
+		}
+	}
+
 	return
 }
+
+// orgUnitScope is a Google organizational unit in the SCIM scope
+type orgUnitScope struct {
+	path         string
+	withSubUnits bool
+}
+
+// isOrgUnitEntry checks if a "SCIM Group" entry is an organizational unit path, e.g. "/Engineering" or "/Engineering/*"
+func isOrgUnitEntry(entry string) bool {
+	return strings.HasPrefix(entry, "/")
+}
+
+// parseOrgUnitEntry parses an organizational unit path. A "/*" suffix includes sub-units
+// The root organizational unit is not supported
+func parseOrgUnitEntry(entry string) (scope *orgUnitScope, err error) {
+	scope = &orgUnitScope{
+		path: strings.TrimSpace(entry),
+	}
+	if strings.HasSuffix(scope.path, "/*") {
+		scope.withSubUnits = true
+		scope.path = strings.TrimSuffix(scope.path, "/*")
+	}
+	scope.path = strings.TrimRight(scope.path, "/")
+	if len(scope.path) == 0 {
+		scope = nil
+		err = fmt.Errorf("root organizational unit \"%s\" is not supported. List top-level organizational units instead", entry)
+	}
+	return
+}
+
+// contains checks if a user's organizational unit belongs to the scope
+func (ous *orgUnitScope) contains(orgUnitPath string) bool {
+	if strings.EqualFold(orgUnitPath, ous.path) {
+		return true
+	}
+	if !ous.withSubUnits {
+		return false
+	}
+	var prefix = ous.path
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return len(orgUnitPath) > len(prefix) && strings.EqualFold(orgUnitPath[:len(prefix)], prefix)
+}
+
+// nestedGroupCycle returns the cycle description if the group memberId is an ancestor of the group groupId
+// parents maps a group ID to the group it was found in
+func nestedGroupCycle(parents map[string]string, groupId string, memberId string, emails map[string]string) string {
+	var path = []string{groupId}
+	for current := groupId; current != memberId; {
+		var ok bool
+		if current, ok = parents[current]; !ok || len(current) == 0 {
+			return ""
+		}
+		path = append(path, current)
+	}
+	var names = []string{emails[memberId]}
+	for i := len(path) - 2; i >= 0; i-- {
+		names = append(names, emails[path[i]])
+	}
+	names = append(names, emails[memberId])
+	return strings.Join(names, " -> ")
+}
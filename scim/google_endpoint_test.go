@@ -0,0 +1,91 @@
+package scim
+
+import (
+	"testing"
+)
+
+func TestParseNestedGroupMode(t *testing.T) {
+	var tests = []struct {
+		value    string
+		expected NestedGroupMode
+		invalid  bool
+	}{
+		{value: "", expected: FlattenNestedGroups},
+		{value: " Flatten ", expected: FlattenNestedGroups},
+		{value: "mirror", expected: MirrorNestedGroups},
+		{value: "direct", expected: DirectNestedGroups},
+		{value: "Direct-Only", expected: DirectNestedGroups},
+		{value: "nested", invalid: true},
+	}
+	for _, tt := range tests {
+		var mode, err = ParseNestedGroupMode(tt.value)
+		if invalid := err != nil; invalid != tt.invalid {
+			t.Errorf("\"%s\": error %v", tt.value, err)
+		} else if mode != tt.expected {
+			t.Errorf("\"%s\": \"%s\", expected \"%s\"", tt.value, mode, tt.expected)
+		}
+	}
+}
+
+func TestNestedGroupCycle(t *testing.T) {
+	// g1 contains g2, g2 contains g3 and g4
+	var parents = map[string]string{"g1": "", "g2": "g1", "g3": "g2", "g4": "g2"}
+	var emails = map[string]string{"g1": "a@company.com", "g2": "b@company.com", "g3": "c@company.com", "g4": "d@company.com"}
+	var tests = []struct {
+		groupId  string
+		memberId string
+		expected string
+	}{
+		{groupId: "g3", memberId: "g1", expected: "a@company.com -> b@company.com -> c@company.com -> a@company.com"},
+		{groupId: "g3", memberId: "g2", expected: "b@company.com -> c@company.com -> b@company.com"},
+		{groupId: "g2", memberId: "g2", expected: "b@company.com -> b@company.com"},
+		{groupId: "g3", memberId: "g4", expected: ""},
+		{groupId: "g4", memberId: "g5", expected: ""},
+		{groupId: "g5", memberId: "g1", expected: ""},
+	}
+	for _, tt := range tests {
+		if actual := nestedGroupCycle(parents, tt.groupId, tt.memberId, emails); actual != tt.expected {
+			t.Errorf("%s in %s: \"%s\", expected \"%s\"", tt.memberId, tt.groupId, actual, tt.expected)
+		}
+	}
+}
+
+func TestOrgUnitScope(t *testing.T) {
+	var tests = []struct {
+		entry    string
+		path     string
+		contains map[string]bool
+		invalid  bool
+	}{
+		{entry: "/Engineering", path: "/Engineering", contains: map[string]bool{
+			"/Engineering": true, "/engineering": true, "/Engineering/QA": false, "/EngineeringOps": false, "/": false}},
+		{entry: " /Engineering/* ", path: "/Engineering", contains: map[string]bool{
+			"/Engineering": true, "/Engineering/QA": true, "/ENGINEERING/QA/Tools": true, "/EngineeringOps": false, "/Sales": false}},
+		{entry: "/Engineering/", path: "/Engineering", contains: map[string]bool{
+			"/Engineering": true, "/Engineering/QA": false}},
+		{entry: "/", invalid: true},
+		{entry: "/*", invalid: true},
+		{entry: "//", invalid: true},
+	}
+	for _, tt := range tests {
+		var scope, err = parseOrgUnitEntry(tt.entry)
+		if invalid := err != nil; invalid != tt.invalid {
+			t.Errorf("\"%s\": error %v", tt.entry, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if scope.path != tt.path {
+			t.Errorf("\"%s\": path \"%s\", expected \"%s\"", tt.entry, scope.path, tt.path)
+		}
+		for orgUnitPath, expected := range tt.contains {
+			if actual := scope.contains(orgUnitPath); actual != expected {
+				t.Errorf("\"%s\" contains \"%s\": %t", tt.entry, orgUnitPath, actual)
+			}
+		}
+	}
+	if !isOrgUnitEntry("/Sales") || isOrgUnitEntry("sales@company.com") {
+		t.Error("organizational unit entries are not recognized")
+	}
+}
@@ -1,9 +1,13 @@
 package scim
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	ksm "github.com/keeper-security/secrets-manager-go/core"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func LoadScimParametersFromRecord(scimRecord *ksm.Record) (ka *ScimEndpointParameters, gcp *GoogleEndpointParameters, err error) {
@@ -11,21 +15,90 @@ func LoadScimParametersFromRecord(scimRecord *ksm.Record) (ka *ScimEndpointParam
 	var credentials = files[0].GetFileData()
 	var subject = scimRecord.GetFieldValueByType("login")
 
+	var queries []*UserQuery
+	if queries, err = ParseUserQueries(scimRecord.GetCustomFieldValueByLabel("SCIM Query")); err != nil {
+		err = fmt.Errorf("\"SCIM Query\" custom field: %s", err.Error())
+		return
+	}
+
 	var fields = scimRecord.GetCustomFieldsByLabel("SCIM Group")
-	if len(fields) == 0 {
+	var orgUnitFields = scimRecord.GetCustomFieldsByLabel("SCIM OrgUnit")
+	if len(fields) == 0 && len(orgUnitFields) == 0 && !hasIncludeQueries(queries) {
 		err = errors.New("\"SCIM Group\" custom field was not found. Please add a custom field \"SCIM Group\" to your record")
 		return
 	}
 	var scimGroups = ParseScimGroups(fields)
-	if len(scimGroups) == 0 {
+	var orgUnits = ParseScimGroups(orgUnitFields)
+	if len(scimGroups) == 0 && len(orgUnits) == 0 && !hasIncludeQueries(queries) {
 		err = errors.New("\"SCIM Group\" custom field does not contain any value")
 		return
 	}
+	var splitEntries = func(value string) []string {
+		return strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == ',' })
+	}
+	for _, orgUnit := range orgUnits {
+		for _, path := range splitEntries(orgUnit) {
+			if path = strings.TrimSpace(path); len(path) == 0 {
+				continue
+			}
+			if !isOrgUnitEntry(path) {
+				err = fmt.Errorf("\"SCIM OrgUnit\" custom field: organizational unit path \"%s\" should start with \"/\"", path)
+				return
+			}
+			if _, err = parseOrgUnitEntry(path); err != nil {
+				err = fmt.Errorf("\"SCIM OrgUnit\" custom field: %s", err.Error())
+				return
+			}
+		}
+	}
+	for _, group := range scimGroups {
+		for _, entry := range splitEntries(group) {
+			if entry = strings.TrimSpace(entry); isOrgUnitEntry(entry) {
+				if _, err = parseOrgUnitEntry(entry); err != nil {
+					err = fmt.Errorf("\"SCIM Group\" custom field: %s", err.Error())
+					return
+				}
+			}
+		}
+	}
 
 	gcp = &GoogleEndpointParameters{
 		AdminAccount: subject,
 		Credentials:  credentials,
 		ScimGroups:   scimGroups,
+		OrgUnits:     orgUnits,
+		Queries:      queries,
+	}
+
+	var mapping = scimRecord.GetCustomFieldValueByLabel("SCIM Mapping")
+	if len(mapping) > 0 {
+		if gcp.AttributeMapping, err = ParseAttributeMapping(mapping); err != nil {
+			err = fmt.Errorf("\"SCIM Mapping\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	var protectedAttribute = scimRecord.GetCustomFieldValueByLabel("Protected Attribute")
+	if len(strings.TrimSpace(protectedAttribute)) > 0 {
+		if gcp.ProtectedAttribute, err = ParseProtectedAttribute(protectedAttribute); err != nil {
+			err = fmt.Errorf("\"Protected Attribute\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	if gcp.NestedGroups, err = ParseNestedGroupMode(scimRecord.GetCustomFieldValueByLabel("Nested Groups")); err != nil {
+		err = fmt.Errorf("\"Nested Groups\" custom field: %s", err.Error())
+		return
+	}
+
+	var nestedGroupDepth = scimRecord.GetCustomFieldValueByLabel("Nested Group Depth")
+	if len(strings.TrimSpace(nestedGroupDepth)) > 0 {
+		var iv int
+		if iv, err = strconv.Atoi(strings.TrimSpace(nestedGroupDepth)); err != nil || iv < 0 {
+			err = fmt.Errorf("\"Nested Group Depth\" custom field: invalid value \"%s\"", nestedGroupDepth)
+			return
+		}
+		gcp.NestedGroupDepth = iv
 	}
 
 	ka = &ScimEndpointParameters{
@@ -59,5 +132,198 @@ func LoadScimParametersFromRecord(scimRecord *ksm.Record) (ka *ScimEndpointParam
 			}
 		}
 	}
+
+	var emailRewrite = scimRecord.GetCustomFieldValueByLabel("Email Rewrite")
+	if len(emailRewrite) > 0 {
+		if ka.EmailRewrite, err = ParseEmailRewriteRules(emailRewrite); err != nil {
+			err = fmt.Errorf("\"Email Rewrite\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	var teamNameTemplate = scimRecord.GetCustomFieldValueByLabel("Team Name Template")
+	if len(strings.TrimSpace(teamNameTemplate)) > 0 {
+		if ka.TeamNameTemplate, err = ParseTeamNameTemplate(teamNameTemplate); err != nil {
+			err = fmt.Errorf("\"Team Name Template\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	var exclusions = scimRecord.GetCustomFieldValueByLabel("SCIM Exclude")
+	if len(exclusions) > 0 {
+		if ka.Exclusions, err = ParseExclusions(exclusions); err != nil {
+			err = fmt.Errorf("\"SCIM Exclude\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	var protectedMarker = scimRecord.GetCustomFieldValueByLabel("Protected Marker")
+	if len(strings.TrimSpace(protectedMarker)) > 0 {
+		if ka.ProtectedMarker, err = ParseProtectedMarker(protectedMarker); err != nil {
+			err = fmt.Errorf("\"Protected Marker\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	var teamMapping = scimRecord.GetCustomFieldValueByLabel("SCIM Team Mapping")
+	if len(teamMapping) > 0 {
+		if ka.TeamMapping, err = ParseTeamMapping(teamMapping); err != nil {
+			err = fmt.Errorf("\"SCIM Team Mapping\" custom field: %s", err.Error())
+			return
+		}
+	}
+	for _, fileName := range []string{"team-mapping.json", "team-mapping.yaml", "team-mapping.yml"} {
+		var mappingFiles = scimRecord.FindFiles(fileName)
+		if len(mappingFiles) == 0 {
+			continue
+		}
+		var fileMapping map[string]string
+		if fileMapping, err = ParseTeamMappingFile(fileName, mappingFiles[0].GetFileData()); err != nil {
+			return
+		}
+		if ka.TeamMapping == nil {
+			ka.TeamMapping = fileMapping
+		} else {
+			for group, team := range fileMapping {
+				if err = addTeamMapping(ka.TeamMapping, group, team); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	var parallelism = scimRecord.GetCustomFieldValueByLabel("Parallelism")
+	if len(parallelism) > 0 {
+		var iv int
+		if iv, err = strconv.Atoi(strings.TrimSpace(parallelism)); err != nil || iv < 1 {
+			err = fmt.Errorf("\"Parallelism\" custom field: invalid value \"%s\"", parallelism)
+			return
+		}
+		ka.Parallelism = int32(iv)
+	}
+
+	fields = scimRecord.GetCustomFieldsByLabel("Rename Alias Matches")
+	if len(fields) > 0 {
+		if bv, ok = toBoolean(fields[0]["value"]); ok {
+			ka.RenameAliasMatches = bv
+		}
+	}
+
+	fields = scimRecord.GetCustomFieldsByLabel("Resume")
+	if len(fields) > 0 {
+		if bv, ok = toBoolean(fields[0]["value"]); ok {
+			ka.Resume = bv
+		}
+	}
+
+	fields = scimRecord.GetCustomFieldsByLabel("Incremental")
+	if len(fields) > 0 {
+		if bv, ok = toBoolean(fields[0]["value"]); ok {
+			ka.Incremental = bv
+		}
+	}
+	var fullSyncInterval = scimRecord.GetCustomFieldValueByLabel("Full Sync Interval")
+	if len(fullSyncInterval) > 0 {
+		if ka.FullSyncInterval, err = parseDuration(fullSyncInterval, time.Hour); err != nil {
+			err = fmt.Errorf("\"Full Sync Interval\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	var gracePeriod = scimRecord.GetCustomFieldValueByLabel("Grace Period")
+	if len(gracePeriod) > 0 {
+		if ka.GracePeriod, err = parseDuration(gracePeriod, time.Hour); err != nil {
+			err = fmt.Errorf("\"Grace Period\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	var deprovision = scimRecord.GetCustomFieldValueByLabel("Deprovision")
+	switch DeprovisionPolicy(strings.ToLower(strings.TrimSpace(deprovision))) {
+	case "", DeleteDeprovision:
+		ka.Deprovision = DeleteDeprovision
+	case DeactivateDeprovision:
+		ka.Deprovision = DeactivateDeprovision
+	default:
+		err = fmt.Errorf("\"Deprovision\" custom field: unsupported value \"%s\". Expected \"delete\" or \"deactivate\"", deprovision)
+		return
+	}
+	var deleteAfter = scimRecord.GetCustomFieldValueByLabel("Delete After")
+	if len(deleteAfter) > 0 {
+		if ka.DeleteDeactivatedAfter, err = parseDuration(deleteAfter, 0); err != nil {
+			err = fmt.Errorf("\"Delete After\" custom field: %s", err.Error())
+			return
+		}
+	}
+
+	var deletionLimit = scimRecord.GetCustomFieldValueByLabel("Deletion Limit")
+	if len(deletionLimit) > 0 {
+		if ka.DeletionLimit, ka.DeletionLimitPercent, err = ParseDeletionLimit(deletionLimit); err != nil {
+			err = fmt.Errorf("\"Deletion Limit\" custom field: %s", err.Error())
+			return
+		}
+	}
+	return
+}
+
+const stateFieldLabel = "SCIM State"
+
+// recordStateMaxSize limits the size of the "SCIM State" field. Keeper records are not meant to keep large data
+const recordStateMaxSize = 256 * 1024
+
+type recordStateStore struct {
+	sm     *ksm.SecretsManager
+	record *ksm.Record
+}
+
+// NewRecordStateStore creates IStateStore that keeps the sync state in the "SCIM State" custom field of the SCIM record
+// KSM application requires edit permission to the record
+func NewRecordStateStore(sm *ksm.SecretsManager, scimRecord *ksm.Record) IStateStore {
+	return &recordStateStore{
+		sm:     sm,
+		record: scimRecord,
+	}
+}
+
+func (rs *recordStateStore) MaxStateSize() int {
+	return recordStateMaxSize
+}
+
+func (rs *recordStateStore) Load() (state *SyncState, err error) {
+	state = new(SyncState)
+	var value = rs.record.GetCustomFieldValueByLabel(stateFieldLabel)
+	if len(value) > 0 {
+		if err = json.Unmarshal([]byte(value), state); err != nil {
+			err = fmt.Errorf("\"%s\" custom field: %s", stateFieldLabel, err.Error())
+		}
+	}
+	return
+}
+
+func (rs *recordStateStore) Save(state *SyncState) (err error) {
+	var data []byte
+	if data, err = json.Marshal(state); err != nil {
+		return
+	}
+	if len(rs.record.GetCustomFieldsByLabel(stateFieldLabel)) > 0 {
+		rs.record.SetCustomFieldValueSingle(stateFieldLabel, string(data))
+	} else {
+		var field = ksm.NewSecret(string(data))
+		field.Label = stateFieldLabel
+		if err = rs.record.AddCustomField(field); err != nil {
+			return
+		}
+	}
+	if err = rs.sm.Save(rs.record); err != nil {
+		return
+	}
+	// the record revision is not updated on save. The record is reloaded so that the next save is not rejected as stale
+	var records []*ksm.Record
+	if records, err = rs.sm.GetSecrets([]string{rs.record.Uid}); err != nil {
+		return
+	}
+	if len(records) > 0 {
+		rs.record = records[0]
+	}
 	return
 }
@@ -0,0 +1,114 @@
+package scim
+
+import (
+	"fmt"
+	"golang.org/x/text/cases"
+	"sort"
+	"strings"
+)
+
+const managerValueAttribute = managerAttribute + ".value"
+
+// managerCycles finds Google users whose manager chain leads back to themselves
+// The result maps Google user ID to the cycle description
+func managerCycles(users map[string]*User) (cycles map[string]string) {
+	cycles = make(map[string]string)
+	var fold = cases.Fold()
+	var byEmail = make(map[string]*User)
+	for _, user := range users {
+		byEmail[fold.String(user.Email)] = user
+	}
+	for _, googleId := range sortedUserIds(users) {
+		var user = users[googleId]
+		if _, ok := cycles[user.Id]; ok {
+			continue
+		}
+		var chain []*User
+		var visited = make(map[string]int)
+		var current = user
+		for current != nil && len(current.Manager) > 0 {
+			if pos, ok := visited[current.Id]; ok {
+				var emails []string
+				for _, u := range chain[pos:] {
+					emails = append(emails, u.Email)
+				}
+				emails = append(emails, current.Email)
+				var description = strings.Join(emails, " -> ")
+				for _, u := range chain[pos:] {
+					cycles[u.Id] = description
+				}
+				break
+			}
+			visited[current.Id] = len(chain)
+			chain = append(chain, current)
+			current = byEmail[fold.String(current.Manager)]
+		}
+	}
+	return
+}
+
+// planManagers links users to managers created in the same run and reports managers that cannot be linked
+// linked maps Google user ID to the matched or created Keeper user
+func (s *sync) planManagers(plan *SyncPlan, users map[string]*User, linked map[string]*scimUser,
+	userLookup map[string]*scimUser, cycles map[string]string) {
+	for _, googleId := range sortedUserIds(users) {
+		var user = users[googleId]
+		var keeperUser, ok = linked[googleId]
+		if !ok || len(user.Manager) == 0 {
+			continue
+		}
+		var op = &PlannedOperation{
+			Kind:         UpdateOperation,
+			ResourceType: UsersResource,
+			Name:         user.Email,
+			KeeperId:     keeperUser.Id,
+			GoogleId:     user.Id,
+			Method:       "PATCH",
+			Attributes:   []string{managerValueAttribute},
+		}
+		if cycle, ok := cycles[user.Id]; ok {
+			op.SkipReason = fmt.Sprintf("manager \"%s\" is not linked due to the manager cycle: %s", user.Manager, cycle)
+			plan.Operations = append(plan.Operations, op)
+			continue
+		}
+		var manager *scimUser
+		if manager, ok = userLookup[s.userKey(user.Manager)]; !ok {
+			op.SkipReason = fmt.Sprintf("manager \"%s\" is outside SCIM scope", user.Manager)
+			plan.Operations = append(plan.Operations, op)
+			continue
+		}
+		if !isPendingKeeperId(manager.Id) {
+			continue
+		}
+		op.Payload = map[string]any{
+			"schemas": []any{"urn:ietf:params:scim:api:messages:2.0:PatchOp"},
+			"Operations": []any{map[string]any{
+				"op":    "replace",
+				"path":  managerValueAttribute,
+				"value": manager.Id,
+			}},
+		}
+		plan.Operations = append(plan.Operations, op)
+		if keeperUser.Resource != nil {
+			setScimAttribute(keeperUser.Resource, managerValueAttribute, manager.Id)
+		}
+	}
+}
+
+// sortedUserIds returns Google user IDs ordered by email
+func sortedUserIds(users map[string]*User) (ids []string) {
+	ids = sortedKeys(users)
+	sort.SliceStable(ids, func(i, j int) bool {
+		return users[ids[i]].Email < users[ids[j]].Email
+	})
+	return
+}
+
+// isManagerLinked checks if the Keeper user already refers to the manager of the Google user
+func (s *sync) isManagerLinked(user *User, keeperUser *scimUser, userLookup map[string]*scimUser) bool {
+	if len(user.Manager) == 0 {
+		return true
+	}
+	var manager, ok = userLookup[s.userKey(user.Manager)]
+	return ok && getScimAttribute(keeperUser.Resource, managerValueAttribute) == manager.Id
+}
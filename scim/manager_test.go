@@ -0,0 +1,119 @@
+package scim
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManagerCycles(t *testing.T) {
+	var users = map[string]*User{
+		"u1": {Id: "u1", Email: "a@company.com", Manager: "b@company.com"},
+		"u2": {Id: "u2", Email: "b@company.com", Manager: "C@company.com"},
+		"u3": {Id: "u3", Email: "c@company.com", Manager: "a@company.com"},
+		"u4": {Id: "u4", Email: "d@company.com", Manager: "a@company.com"},
+		"u5": {Id: "u5", Email: "e@company.com", Manager: "e@company.com"},
+		"u6": {Id: "u6", Email: "f@company.com", Manager: "nobody@company.com"},
+	}
+	var expected = map[string]string{
+		"u1": "a@company.com -> b@company.com -> c@company.com -> a@company.com",
+		"u2": "a@company.com -> b@company.com -> c@company.com -> a@company.com",
+		"u3": "a@company.com -> b@company.com -> c@company.com -> a@company.com",
+		"u5": "e@company.com -> e@company.com",
+	}
+	if actual := managerCycles(users); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("cycles: %v", actual)
+	}
+}
+
+func TestPlanManagers(t *testing.T) {
+	var tests = []struct {
+		name        string
+		users       []*User
+		keeperUsers []map[string]any
+		expected    []string
+		managers    map[string]string
+	}{
+		{
+			name: "manager in the SCIM scope",
+			users: []*User{
+				{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true, Manager: "bob@company.com"},
+				{Id: "u2", Email: "bob@company.com", FullName: "bob@company.com", Active: true},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "alice@company.com", "u1"),
+				scimUserObject("k2", "bob@company.com", "u2"),
+			},
+			expected: []string{"update PATCH k1"},
+			managers: map[string]string{"k1": "k2"},
+		},
+		{
+			name: "manager created by the same plan",
+			users: []*User{
+				{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true, Manager: "bob@company.com"},
+				{Id: "u2", Email: "bob@company.com", FullName: "bob@company.com", Active: true},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "alice@company.com", "u1"),
+			},
+			expected: []string{"create POST " + PendingKeeperId(UsersResource, "u2"), "update PATCH k1"},
+			managers: map[string]string{"k1": PendingKeeperId(UsersResource, "u2")},
+		},
+		{
+			name: "manager outside the SCIM scope with a Keeper account",
+			users: []*User{
+				{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true, Manager: "bob@company.com"},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "alice@company.com", "u1"),
+				scimUserObject("k2", "bob@company.com", "u2"),
+			},
+			expected: []string{"update PATCH k1 (skipped)", "delete DELETE k2"},
+		},
+		{
+			name: "manager cycle",
+			users: []*User{
+				{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true, Manager: "bob@company.com"},
+				{Id: "u2", Email: "bob@company.com", FullName: "bob@company.com", Active: true, Manager: "alice@company.com"},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "alice@company.com", "u1"),
+				scimUserObject("k2", "bob@company.com", "u2"),
+			},
+			expected: []string{"update PATCH k1 (skipped)", "update PATCH k2 (skipped)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s = newTestSync(t, &testSource{users: tt.users}, newTestScim(tt.keeperUsers, nil))
+			var plan = new(SyncPlan)
+			if err := s.planUsers(plan); err != nil {
+				t.Fatal(err)
+			}
+			if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("operations:\n%s\nexpected:\n%s", strings.Join(actual, "\n"), strings.Join(tt.expected, "\n"))
+			}
+			var managers = make(map[string]string)
+			for _, op := range plan.Operations {
+				if len(op.SkipReason) > 0 {
+					continue
+				}
+				var operations, _ = op.Payload["Operations"].([]any)
+				for _, o := range operations {
+					var pop = o.(map[string]any)
+					if pop["path"] == managerValueAttribute {
+						managers[op.KeeperId] = pop["value"].(string)
+					} else if values, ok := pop["value"].(map[string]any); ok && values[managerValueAttribute] != nil {
+						managers[op.KeeperId] = values[managerValueAttribute].(string)
+					}
+				}
+			}
+			if len(tt.managers) == 0 {
+				tt.managers = map[string]string{}
+			}
+			if !reflect.DeepEqual(managers, tt.managers) {
+				t.Errorf("managers: %v, expected: %v", managers, tt.managers)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// AttributeMapping copies a Google user field to a SCIM user attribute
+type AttributeMapping struct {
+	// Attribute is SCIM attribute path, e.g. "title", "name.honorificPrefix"
+	// or "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department"
+	Attribute string
+	// Source is Google Admin user field path, e.g. "organizations[primary].department",
+	// "phones[type=work].value", "externalIds[0].value" or "customSchemas.HR.CostCenter"
+	Source string
+	// Negate inverts a boolean source value. Set by the "!" source prefix
+	Negate bool
+}
+
+const enterpriseUserSchema = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+
+// managerAttribute receives the manager's email. It is resolved to Keeper user ID on sync
+const managerAttribute = enterpriseUserSchema + ":manager"
+
+// enterpriseAttributeMapping populates the enterprise user extension unless these attributes are mapped explicitly
+var enterpriseAttributeMapping = []*AttributeMapping{
+	{Attribute: "title", Source: "organizations.title"},
+	{Attribute: enterpriseUserSchema + ":department", Source: "organizations.department"},
+	{Attribute: enterpriseUserSchema + ":costCenter", Source: "organizations.costCenter"},
+	{Attribute: enterpriseUserSchema + ":organization", Source: "organizations.name"},
+	{Attribute: enterpriseUserSchema + ":employeeNumber", Source: "externalIds[type=organization].value"},
+	{Attribute: managerAttribute, Source: "relations[type=manager].value"},
+}
+
+// withEnterpriseMapping adds the enterprise user extension attributes to the attribute mapping
+func withEnterpriseMapping(mapping []*AttributeMapping) (result []*AttributeMapping) {
+	var mapped = NewSet[string]()
+	for _, am := range mapping {
+		mapped.Add(am.Attribute)
+		result = append(result, am)
+	}
+	for _, am := range enterpriseAttributeMapping {
+		if !mapped.Has(am.Attribute) {
+			result = append(result, am)
+		}
+	}
+	return
+}
+
+var reservedScimAttributes = MakeSet[string]([]string{"id", "userName", "externalId", "groups", "schemas", "meta"})
+
+// ParseAttributeMapping parses the "SCIM Mapping" content
+// Each line has the form "<SCIM attribute> = <Google user field>". Empty lines and lines starting with "#" are ignored
+func ParseAttributeMapping(value string) (mapping []*AttributeMapping, err error) {
+	var attributes = NewSet[string]()
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var pos = strings.Index(line, "=")
+		if pos <= 0 {
+			err = fmt.Errorf("invalid attribute mapping \"%s\": expected \"<SCIM attribute> = <Google user field>\"", line)
+			return
+		}
+		var am = &AttributeMapping{
+			Attribute: strings.TrimSpace(line[:pos]),
+			Source:    strings.TrimSpace(line[pos+1:]),
+		}
+		if strings.HasPrefix(am.Source, "!") {
+			am.Negate = true
+			am.Source = strings.TrimSpace(am.Source[1:])
+		}
+		if len(am.Source) == 0 {
+			err = fmt.Errorf("invalid attribute mapping \"%s\": Google user field is empty", line)
+			return
+		}
+		if _, err = parseSourcePath(am.Source); err != nil {
+			err = fmt.Errorf("invalid attribute mapping \"%s\": %s", line, err.Error())
+			return
+		}
+		var _, attrPath = splitScimAttribute(am.Attribute)
+		if len(attrPath) == 0 || reservedScimAttributes.Has(am.Attribute) {
+			err = fmt.Errorf("invalid attribute mapping \"%s\": SCIM attribute \"%s\" cannot be mapped", line, am.Attribute)
+			return
+		}
+		if attributes.Has(am.Attribute) {
+			err = fmt.Errorf("invalid attribute mapping \"%s\": SCIM attribute \"%s\" is mapped more than once", line, am.Attribute)
+			return
+		}
+		attributes.Add(am.Attribute)
+		mapping = append(mapping, am)
+	}
+	return
+}
+
+type sourcePathElement struct {
+	name     string
+	selector string
+}
+
+// parseSourcePath splits a Google user field path into elements
+// Element selectors are enclosed in brackets and may contain dots
+func parseSourcePath(path string) (elements []*sourcePathElement, err error) {
+	var element = new(sourcePathElement)
+	var selector = -1
+	for i, ch := range path {
+		switch {
+		case selector >= 0:
+			if ch == ']' {
+				element.selector = strings.TrimSpace(path[selector:i])
+				selector = -1
+			}
+		case ch == '[':
+			selector = i + 1
+		case ch == '.':
+			if len(element.name) == 0 {
+				err = fmt.Errorf("empty field name in \"%s\"", path)
+				return
+			}
+			elements = append(elements, element)
+			element = new(sourcePathElement)
+		default:
+			element.name += string(ch)
+		}
+	}
+	if selector >= 0 {
+		err = fmt.Errorf("unclosed bracket in \"%s\"", path)
+		return
+	}
+	if len(element.name) == 0 {
+		err = fmt.Errorf("empty field name in \"%s\"", path)
+		return
+	}
+	elements = append(elements, element)
+	return
+}
+
+// selectElement picks an array element by the selector: an index, "primary" or "<field>=<value>"
+// An array without selector resolves to its primary or first element
+func selectElement(array []any, selector string) any {
+	if len(array) == 0 {
+		return nil
+	}
+	if index, err := strconv.Atoi(selector); err == nil {
+		if index >= 0 && index < len(array) {
+			return array[index]
+		}
+		return nil
+	}
+	var key, value = "primary", "true"
+	if len(selector) > 0 && selector != "primary" {
+		var pos = strings.Index(selector, "=")
+		if pos < 0 {
+			return nil
+		}
+		key = strings.TrimSpace(selector[:pos])
+		value = strings.Trim(strings.TrimSpace(selector[pos+1:]), "\"'")
+	}
+	for _, e := range array {
+		if eo, ok := e.(map[string]any); ok {
+			if fv, ok := eo[key]; ok && fv != nil && fmt.Sprint(fv) == value {
+				return e
+			}
+		}
+	}
+	if len(selector) == 0 {
+		return array[0]
+	}
+	return nil
+}
+
+// resolveSourceValue returns the value of a Google user field. The user is in its JSON form
+func resolveSourceValue(user map[string]any, path string) (value any) {
+	var elements, err = parseSourcePath(path)
+	if err != nil {
+		return
+	}
+	value = user
+	for i, element := range elements {
+		var obj, ok = value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = obj[element.name]
+		if array, ok := value.([]any); ok && (len(element.selector) > 0 || i < len(elements)-1) {
+			value = selectElement(array, element.selector)
+		}
+		if value == nil {
+			return
+		}
+	}
+	return
+}
+
+// mapUserAttributes applies attribute mapping to a Google user
+// displayName, name.givenName, name.familyName, active and the enterprise manager update the corresponding User fields.
+// All other attributes are stored in User.Attributes
+func mapUserAttributes(user *User, googleUser any, mapping []*AttributeMapping, logger SyncDebugLogger) {
+	if len(mapping) == 0 {
+		return
+	}
+	var data, err = json.Marshal(googleUser)
+	if err != nil {
+		return
+	}
+	var jo map[string]any
+	if err = json.Unmarshal(data, &jo); err != nil {
+		return
+	}
+	for _, am := range mapping {
+		var value = normalizeAttributeValue(resolveSourceValue(jo, am.Source))
+		if am.Negate && value != nil {
+			var bv, ok = toBoolean(value)
+			if !ok {
+				logger(fmt.Sprintf("User \"%s\": field \"%s\" is not boolean", user.Email, am.Source))
+				continue
+			}
+			value = !bv
+		}
+		switch am.Attribute {
+		case "displayName", "name.givenName", "name.familyName", managerAttribute:
+			var sv = ""
+			if value != nil {
+				if s, ok := value.(string); ok {
+					sv = s
+				} else {
+					sv = fmt.Sprint(value)
+				}
+			}
+			switch am.Attribute {
+			case "displayName":
+				user.FullName = sv
+			case "name.givenName":
+				user.FirstName = sv
+			case "name.familyName":
+				user.LastName = sv
+			case managerAttribute:
+				user.Manager = sv
+			}
+		case "active":
+			if value != nil {
+				if bv, ok := toBoolean(value); ok {
+					user.Active = bv
+				} else {
+					logger(fmt.Sprintf("User \"%s\": field \"%s\" is not boolean", user.Email, am.Source))
+				}
+			}
+		default:
+			if user.Attributes == nil {
+				user.Attributes = make(map[string]any)
+			}
+			user.Attributes[am.Attribute] = value
+		}
+	}
+}
+
+// normalizeAttributeValue treats empty strings, arrays and objects as missing values
+func normalizeAttributeValue(value any) any {
+	switch v := value.(type) {
+	case string:
+		if len(v) == 0 {
+			return nil
+		}
+	case []any:
+		if len(v) == 0 {
+			return nil
+		}
+	case map[string]any:
+		if len(v) == 0 {
+			return nil
+		}
+	}
+	return value
+}
+
+func equalAttributeValues(v1 any, v2 any) bool {
+	return reflect.DeepEqual(normalizeAttributeValue(v1), normalizeAttributeValue(v2))
+}
+
+// splitScimAttribute separates the schema URN from the attribute path
+func splitScimAttribute(attribute string) (schema string, path string) {
+	path = attribute
+	if strings.HasPrefix(attribute, "urn:") {
+		var pos = strings.LastIndex(attribute, ":")
+		schema = attribute[:pos]
+		path = attribute[pos+1:]
+	}
+	return
+}
+
+// getScimAttribute reads an attribute value from a SCIM resource
+func getScimAttribute(resource map[string]any, attribute string) (value any) {
+	var schema, path = splitScimAttribute(attribute)
+	var obj = resource
+	if len(schema) > 0 {
+		var ok bool
+		if obj, ok = resource[schema].(map[string]any); !ok {
+			return
+		}
+	}
+	var names = strings.Split(path, ".")
+	for i, name := range names {
+		value = obj[name]
+		if i < len(names)-1 {
+			var ok bool
+			if obj, ok = value.(map[string]any); !ok {
+				return nil
+			}
+		}
+	}
+	return
+}
+
+// setScimAttribute writes an attribute value to a SCIM resource and registers the attribute schema
+func setScimAttribute(resource map[string]any, attribute string, value any) {
+	var schema, path = splitScimAttribute(attribute)
+	var obj = resource
+	if len(schema) > 0 {
+		if schemas, ok := resource["schemas"].([]any); ok {
+			var found = false
+			for _, s := range schemas {
+				if s == schema {
+					found = true
+				}
+			}
+			if !found {
+				resource["schemas"] = append(schemas, schema)
+			}
+		}
+		obj = getOrCreateObject(resource, schema)
+	}
+	var names = strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		obj = getOrCreateObject(obj, name)
+	}
+	obj[names[len(names)-1]] = value
+}
+
+// cloneResource makes a deep copy of a SCIM resource
+func cloneResource(resource map[string]any) map[string]any {
+	var clone func(value any) any
+	clone = func(value any) any {
+		switch v := value.(type) {
+		case map[string]any:
+			var m = make(map[string]any, len(v))
+			for k, e := range v {
+				m[k] = clone(e)
+			}
+			return m
+		case []any:
+			var a = make([]any, len(v))
+			for i, e := range v {
+				a[i] = clone(e)
+			}
+			return a
+		}
+		return value
+	}
+	return clone(resource).(map[string]any)
+}
+
+func getOrCreateObject(obj map[string]any, name string) map[string]any {
+	var child, ok = obj[name].(map[string]any)
+	if !ok {
+		child = make(map[string]any)
+		obj[name] = child
+	}
+	return child
+}
+
+// mappedAttributeOperations compares mapped attribute values with a SCIM user
+// and returns PATCH operations for the attributes that differ
+func mappedAttributeOperations(values map[string]any, keeperUser *scimUser) (operations []any, attributes []string) {
+	for _, attribute := range sortedKeys(values) {
+		var value = values[attribute]
+		if equalAttributeValues(getScimAttribute(keeperUser.Resource, attribute), value) {
+			continue
+		}
+		var op = map[string]any{
+			"path": attribute,
+		}
+		if value == nil {
+			op["op"] = "remove"
+			if attribute == managerValueAttribute {
+				op["path"] = managerAttribute
+			}
+		} else {
+			op["op"] = "replace"
+			op["value"] = value
+		}
+		operations = append(operations, op)
+		attributes = append(attributes, attribute)
+	}
+	return
+}
+
+// userAttributes returns mapped SCIM attribute values of a Google user
+// The manager's email is resolved to Keeper user ID. The manager is left unchanged if it cannot be resolved,
+// is created in the same run, or is a part of the manager cycle
+func (s *sync) userAttributes(user *User, userLookup map[string]*scimUser, cycles map[string]string) (values map[string]any) {
+	values = make(map[string]any)
+	for k, v := range user.Attributes {
+		values[k] = v
+	}
+	if _, ok := cycles[user.Id]; ok {
+		return
+	}
+	if len(user.Manager) == 0 {
+		values[managerValueAttribute] = nil
+	} else if manager, ok := userLookup[s.userKey(user.Manager)]; ok && !isPendingKeeperId(manager.Id) {
+		values[managerValueAttribute] = manager.Id
+	}
+	return
+}
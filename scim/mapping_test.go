@@ -0,0 +1,123 @@
+package scim
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSourcePath(t *testing.T) {
+	var tests = []struct {
+		path     string
+		expected []sourcePathElement
+		invalid  bool
+	}{
+		{path: "orgUnitPath", expected: []sourcePathElement{{name: "orgUnitPath"}}},
+		{path: "organizations[primary].title", expected: []sourcePathElement{
+			{name: "organizations", selector: "primary"}, {name: "title"}}},
+		{path: "emails[ address = a.b@company.com ].type", expected: []sourcePathElement{
+			{name: "emails", selector: "address = a.b@company.com"}, {name: "type"}}},
+		{path: "customSchemas.HR.CostCenter", expected: []sourcePathElement{
+			{name: "customSchemas"}, {name: "HR"}, {name: "CostCenter"}}},
+		{path: "externalIds[0].value", expected: []sourcePathElement{
+			{name: "externalIds", selector: "0"}, {name: "value"}}},
+		{path: "organizations[primary.title", invalid: true},
+		{path: "customSchemas..HR", invalid: true},
+		{path: ".title", invalid: true},
+		{path: "title.", invalid: true},
+	}
+	for _, tt := range tests {
+		var elements, err = parseSourcePath(tt.path)
+		if invalid := err != nil; invalid != tt.invalid {
+			t.Errorf("\"%s\": error %v", tt.path, err)
+		}
+		if err != nil {
+			continue
+		}
+		var actual []sourcePathElement
+		for _, element := range elements {
+			actual = append(actual, *element)
+		}
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("\"%s\": %v, expected: %v", tt.path, actual, tt.expected)
+		}
+	}
+}
+
+func TestResolveSourceValue(t *testing.T) {
+	var user = map[string]any{
+		"orgUnitPath": "/Sales",
+		"suspended":   false,
+		"organizations": []any{
+			map[string]any{"title": "Intern", "department": "Support"},
+			map[string]any{"title": "Engineer", "department": "R&D", "primary": true},
+		},
+		"phones": []any{
+			map[string]any{"type": "home", "value": "111"},
+			map[string]any{"type": "work", "value": "222"},
+		},
+		"externalIds": []any{
+			map[string]any{"type": "organization", "value": "E-42"},
+		},
+		"customSchemas": map[string]any{
+			"HR": map[string]any{"CostCenter": "CC-7"},
+		},
+	}
+	var tests = []struct {
+		path     string
+		expected any
+	}{
+		{path: "orgUnitPath", expected: "/Sales"},
+		{path: "suspended", expected: false},
+		{path: "organizations.title", expected: "Engineer"},
+		{path: "organizations[primary].department", expected: "R&D"},
+		{path: "organizations[0].title", expected: "Intern"},
+		{path: "organizations[5].title", expected: nil},
+		{path: "phones.value", expected: "111"},
+		{path: "phones[type=work].value", expected: "222"},
+		{path: "phones[type='work'].value", expected: "222"},
+		{path: "phones[type=mobile].value", expected: nil},
+		{path: "phones[work].value", expected: nil},
+		{path: "externalIds[type=organization].value", expected: "E-42"},
+		{path: "customSchemas.HR.CostCenter", expected: "CC-7"},
+		{path: "customSchemas.HR.Missing", expected: nil},
+		{path: "orgUnitPath.name", expected: nil},
+		{path: "phones[type=work", expected: nil},
+	}
+	for _, tt := range tests {
+		if actual := resolveSourceValue(user, tt.path); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("\"%s\": %v, expected: %v", tt.path, actual, tt.expected)
+		}
+	}
+}
+
+func TestParseAttributeMapping(t *testing.T) {
+	var mapping, err = ParseAttributeMapping(`
+# comment
+title = organizations[primary].title
+active = !suspended
+urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:costCenter = customSchemas.HR.CostCenter
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []*AttributeMapping{
+		{Attribute: "title", Source: "organizations[primary].title"},
+		{Attribute: "active", Source: "suspended", Negate: true},
+		{Attribute: enterpriseUserSchema + ":costCenter", Source: "customSchemas.HR.CostCenter"},
+	}
+	if !reflect.DeepEqual(mapping, expected) {
+		t.Errorf("mapping: %v", mapping)
+	}
+	for _, value := range []string{
+		"title",
+		"title =",
+		"= organizations.title",
+		"userName = primaryEmail",
+		"title = organizations[primary.title",
+		"title = organizations.title\ntitle = organizations.name",
+	} {
+		if _, err = ParseAttributeMapping(value); err == nil {
+			t.Errorf("\"%s\" is accepted", value)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package scim
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+const pendingPrefix = "pending:"
+const planVersion = 1
+
+// deadlineMargin is the time reserved to complete started requests and report results
+const deadlineMargin = 10 * time.Second
+
+// PendingKeeperId returns a reference to a Keeper resource that is created by the same plan
+// resourceType: SCIM resource type
+// googleId: ID of the source resource the Keeper resource is created for
+func PendingKeeperId(resourceType ResourceType, googleId string) string {
+	return fmt.Sprintf("%s%s:%s", pendingPrefix, resourceType, googleId)
+}
+
+func isPendingKeeperId(keeperId string) bool {
+	return strings.HasPrefix(keeperId, pendingPrefix)
+}
+
+func (rt ResourceType) noun() string {
+	switch rt {
+	case UsersResource:
+		return "user"
+	case GroupsResource:
+		return "group"
+	}
+	return strings.ToLower(string(rt))
+}
+
+// resolveReferences returns a copy of the payload with pending references replaced with Keeper IDs
+func resolveReferences(value any, resolved map[string]string) (result any, err error) {
+	switch v := value.(type) {
+	case string:
+		if isPendingKeeperId(v) {
+			var ok bool
+			if result, ok = resolved[v]; !ok {
+				err = fmt.Errorf("resource \"%s\" was not created", v)
+			}
+		} else {
+			result = v
+		}
+	case map[string]any:
+		var m = make(map[string]any)
+		for k, e := range v {
+			if m[k], err = resolveReferences(e, resolved); err != nil {
+				return
+			}
+		}
+		result = m
+	case []any:
+		var a = make([]any, len(v))
+		for i, e := range v {
+			if a[i], err = resolveReferences(e, resolved); err != nil {
+				return
+			}
+		}
+		result = a
+	default:
+		result = v
+	}
+	return
+}
+
+func membershipChanges(payload map[string]any) (added int, removed int) {
+	var operations, _ = payload["Operations"].([]any)
+	for _, o := range operations {
+		var op, ok = o.(map[string]any)
+		if !ok {
+			continue
+		}
+		var values, _ = op["value"].([]any)
+		switch op["op"] {
+		case "add":
+			added += len(values)
+		case "remove":
+			removed += len(values)
+		}
+	}
+	return
+}
+
+// collectReferences adds pending references found in the payload to the set
+func collectReferences(value any, refs Set[string]) {
+	switch v := value.(type) {
+	case string:
+		if isPendingKeeperId(v) {
+			refs.Add(v)
+		}
+	case map[string]any:
+		for _, e := range v {
+			collectReferences(e, refs)
+		}
+	case []any:
+		for _, e := range v {
+			collectReferences(e, refs)
+		}
+	}
+}
+
+// executeOperation sends a planned operation to SCIM endpoint
+// resolved is not modified. The Keeper ID of a created resource is returned
+func (s *sync) executeOperation(ctx context.Context, op *PlannedOperation, resolved map[string]string) (createdId string, err error) {
+	var keeperId = op.KeeperId
+	var payload map[string]any
+	if op.Method != "POST" && isPendingKeeperId(keeperId) {
+		var ok bool
+		if keeperId, ok = resolved[keeperId]; !ok {
+			err = fmt.Errorf("%s \"%s\" was not created", op.ResourceType.noun(), op.Name)
+			return
+		}
+	}
+	if op.Payload != nil {
+		var rp any
+		if rp, err = resolveReferences(op.Payload, resolved); err != nil {
+			return
+		}
+		payload = rp.(map[string]any)
+	}
+
+	switch op.Method {
+	case "POST":
+		var added map[string]any
+		if added, err = s.postResource(ctx, string(op.ResourceType), payload); err != nil {
+			return
+		}
+		var ok bool
+		if createdId, ok = toString(added["id"]); !ok {
+			err = fmt.Errorf("POST %s \"%s\": response does not contain \"id\"", op.ResourceType.noun(), op.Name)
+			return
+		}
+	case "PATCH":
+		err = s.patchResource(ctx, string(op.ResourceType), keeperId, payload)
+	case "DELETE":
+		err = s.deleteResource(ctx, string(op.ResourceType), keeperId)
+	default:
+		err = fmt.Errorf("unsupported SCIM method \"%s\"", op.Method)
+	}
+	return
+}
+
+func newSyncRecord(op *PlannedOperation) (record *SyncRecord) {
+	record = &SyncRecord{
+		Kind:         op.Kind,
+		ResourceType: op.ResourceType,
+		Name:         op.Name,
+		GoogleId:     op.GoogleId,
+		KeeperId:     op.KeeperId,
+		Attributes:   op.Attributes,
+		SkipReason:   op.SkipReason,
+		Note:         op.Note,
+	}
+	if op.Kind == MembershipOperation {
+		record.Added, record.Removed = membershipChanges(op.Payload)
+	}
+	return
+}
+
+// canStart checks if there is enough time left to start another SCIM request
+func canStart(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < deadlineMargin {
+		return false
+	}
+	return true
+}
+
+// executeBatch runs independent operations on up to "parallelism" workers
+// Operations that were not started due to the deadline are left without a record
+func (s *sync) executeBatch(ctx context.Context, operations []*PlannedOperation, batch []int, records []*SyncRecord, resolved map[string]string) {
+	var created = make([]string, len(batch))
+	var execute = func(n int) {
+		var op = operations[batch[n]]
+		var record = newSyncRecord(op)
+		if !record.Skipped() {
+			if !canStart(ctx) {
+				return
+			}
+			if keeperId, er1 := s.executeOperation(ctx, op, resolved); er1 == nil {
+				created[n] = keeperId
+			} else {
+				record.Error = er1.Error()
+			}
+		}
+		records[batch[n]] = record
+	}
+
+	var workers = min(int(s.parallelism), len(batch))
+	if workers <= 1 {
+		for n := range batch {
+			execute(n)
+		}
+	} else {
+		var queue = make(chan int)
+		var wg gosync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := range queue {
+					execute(n)
+				}
+			}()
+		}
+		for n := range batch {
+			queue <- n
+		}
+		close(queue)
+		wg.Wait()
+	}
+
+	for n, i := range batch {
+		if len(created[n]) > 0 {
+			resolved[operations[i].KeeperId] = created[n]
+		}
+	}
+	for _, i := range batch {
+		if records[i] == nil {
+			continue
+		}
+		if keeperId, ok := resolved[records[i].KeeperId]; ok {
+			records[i].KeeperId = keeperId
+		}
+	}
+}
+
+// executePlan sends planned operations to SCIM endpoint preserving the plan order where it matters:
+// an operation starts a new batch if it touches a resource that is created or modified in the current batch
+// No new operations are started once the context deadline is near. The returned stat is marked as incomplete then
+// checkpoint, if provided, holds operations executed by a previous run and receives the progress of this run
+func (s *sync) executePlan(ctx context.Context, plan *SyncPlan, checkpoint *SyncCheckpoint) (stat *SyncStat) {
+	stat = new(SyncStat)
+	stat.Warnings = append([]string(nil), plan.Warnings...)
+	var records = make([]*SyncRecord, len(plan.Operations))
+	var resolved = make(map[string]string)
+	var done = NewSet[int]()
+	if checkpoint != nil {
+		for k, v := range checkpoint.Resolved {
+			resolved[k] = v
+		}
+		done.Union(checkpoint.Done)
+		stat.Resumed = len(done) > 0
+	}
+	var batch []int
+	var touched = NewSet[string]()
+	for i, op := range plan.Operations {
+		if done.Has(i) {
+			continue
+		}
+		if !canStart(ctx) {
+			break
+		}
+		if len(op.SkipReason) == 0 {
+			var refs = NewSet[string]()
+			collectReferences(op.Payload, refs)
+			refs.Add(op.KeeperId)
+			var dependent = false
+			refs.Enumerate(func(ref string) bool {
+				dependent = touched.Has(ref)
+				return !dependent
+			})
+			if dependent {
+				s.executeBatch(ctx, plan.Operations, batch, records, resolved)
+				batch = nil
+				touched = NewSet[string]()
+			}
+			touched.Add(op.KeeperId)
+		}
+		batch = append(batch, i)
+	}
+	if len(batch) > 0 {
+		s.executeBatch(ctx, plan.Operations, batch, records, resolved)
+	}
+	for i, record := range records {
+		if record != nil {
+			stat.addRecord(record)
+			done.Add(i)
+		} else if !done.Has(i) {
+			stat.Pending++
+		}
+	}
+	if stat.Pending > 0 {
+		stat.Incomplete = true
+		s.debugLogger(fmt.Sprintf("Sync deadline reached: %d operation(s) were not started", stat.Pending))
+	}
+	if checkpoint != nil {
+		checkpoint.Done = done.ToArray()
+		sort.Ints(checkpoint.Done)
+		checkpoint.Resolved = resolved
+		var incomplete = MakeSet[string](checkpoint.Incomplete)
+		for _, record := range stat.Records {
+			if record.ResourceType == UsersResource && !record.Success() && len(record.GoogleId) > 0 {
+				incomplete.Add(record.GoogleId)
+			}
+		}
+		checkpoint.Incomplete = incomplete.ToArray()
+		sort.Strings(checkpoint.Incomplete)
+	}
+	return
+}
+
+func hashScimUser(user *scimUser) string {
+	var groups = append([]string(nil), user.Groups...)
+	sort.Strings(groups)
+	var data, _ = json.Marshal([]any{user.Email, user.ExternalId, user.FullName, user.FirstName, user.LastName, user.Active, groups})
+	var hash = sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hashScimGroup(group *scimGroup) string {
+	var data, _ = json.Marshal([]any{group.Name, group.ExternalId})
+	var hash = sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// snapshotScim captures Keeper users and teams loaded by populateScim
+func (s *sync) snapshotScim() (users []*ScimResourceState, groups []*ScimResourceState) {
+	for _, u := range s.scimUsers {
+		users = append(users, &ScimResourceState{
+			Id:         u.Id,
+			Name:       u.Email,
+			ExternalId: u.ExternalId,
+			Hash:       hashScimUser(u),
+		})
+	}
+	for _, g := range s.scimGroups {
+		groups = append(groups, &ScimResourceState{
+			Id:         g.Id,
+			Name:       g.Name,
+			ExternalId: g.ExternalId,
+			Hash:       hashScimGroup(g),
+		})
+	}
+	var byId = func(rs []*ScimResourceState) func(int, int) bool {
+		return func(i, j int) bool { return rs[i].Id < rs[j].Id }
+	}
+	sort.Slice(users, byId(users))
+	sort.Slice(groups, byId(groups))
+	return
+}
+
+// compareSnapshots returns human-readable differences between the planned and the current state
+func compareSnapshots(resourceType ResourceType, planned []*ScimResourceState, current []*ScimResourceState) (drift []string) {
+	var currentLookup = make(map[string]*ScimResourceState)
+	for _, r := range current {
+		currentLookup[r.Id] = r
+	}
+	var noun = resourceType.noun()
+	for _, p := range planned {
+		if c, ok := currentLookup[p.Id]; ok {
+			if c.Hash != p.Hash {
+				drift = append(drift, fmt.Sprintf("%s \"%s\" was modified", noun, p.Name))
+			}
+			delete(currentLookup, p.Id)
+		} else {
+			drift = append(drift, fmt.Sprintf("%s \"%s\" was removed", noun, p.Name))
+		}
+	}
+	for _, c := range current {
+		if _, ok := currentLookup[c.Id]; ok {
+			drift = append(drift, fmt.Sprintf("%s \"%s\" was added", noun, c.Name))
+		}
+	}
+	return
+}
+
+func (s *sync) ExportPlan(plan *SyncPlan, w io.Writer) (err error) {
+	if plan == nil {
+		err = errors.New("plan is empty")
+		return
+	}
+	var encoder = json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(plan)
+	return
+}
+
+func (s *sync) ImportPlan(r io.Reader) (plan *SyncPlan, err error) {
+	var p = new(SyncPlan)
+	if err = json.NewDecoder(r).Decode(p); err != nil {
+		return
+	}
+	if p.Version != planVersion {
+		err = fmt.Errorf("plan version %d is not supported", p.Version)
+		return
+	}
+	if p.ScimUrl != s.baseUrl {
+		err = fmt.Errorf("plan was created for a different SCIM endpoint \"%s\"", p.ScimUrl)
+		return
+	}
+	plan = p
+	return
+}
+
+// Apply executes a previously computed plan
+// The plan is rejected if Keeper users or teams were changed after the plan had been created
+func (s *sync) Apply(ctx context.Context, plan *SyncPlan) (stat *SyncStat, err error) {
+	if plan == nil {
+		err = errors.New("plan is empty")
+		return
+	}
+	if err = s.populateScim(ctx); err != nil {
+		return
+	}
+	if err = s.loadState(); err != nil {
+		return
+	}
+	if s.state != nil && plan.MissingSince != nil {
+		s.state.MissingSince = plan.MissingSince
+	}
+	var users, groups = s.snapshotScim()
+	var drift = compareSnapshots(UsersResource, plan.Users, users)
+	drift = append(drift, compareSnapshots(GroupsResource, plan.Groups, groups)...)
+	if len(drift) > 0 {
+		for _, txt := range drift {
+			s.debugLogger(txt)
+		}
+		err = fmt.Errorf("SCIM state has changed since the plan was created: %s", strings.Join(drift, "; "))
+		return
+	}
+	plan = s.blockProtected(plan)
+	if err = s.checkDeletionLimit(plan); err != nil {
+		return
+	}
+	s.debugLogger("Execute SCIM operations")
+	stat = s.executePlan(ctx, plan, nil)
+	s.recordResults(stat)
+	err = s.saveState(stat)
+	return
+}
+
+// blockProtected returns the plan with deactivation and deletion of protected Keeper users skipped
+// Users can be protected after the plan was created. The plan is not modified
+func (s *sync) blockProtected(plan *SyncPlan) *SyncPlan {
+	var p = *plan
+	p.Operations = make([]*PlannedOperation, len(plan.Operations))
+	for i, op := range plan.Operations {
+		p.Operations[i] = op
+		if op.ResourceType != UsersResource || len(op.SkipReason) > 0 {
+			continue
+		}
+		if op.Kind != DeleteOperation && op.Kind != DeactivateOperation && !deactivates(op) {
+			continue
+		}
+		if protection := s.protectionOf(s.scimUsers[op.KeeperId], nil); len(protection) > 0 {
+			s.debugLogger(fmt.Sprintf("User \"%s\": %s blocked: %s", op.Name, op.Kind, protection))
+			var blocked = *op
+			blocked.SkipReason = fmt.Sprintf("%s blocked: %s", op.Kind, protection)
+			blocked.Payload = nil
+			p.Operations[i] = &blocked
+		}
+	}
+	return &p
+}
+
+// deactivates checks if the operation payload sets the "active" attribute to false
+func deactivates(op *PlannedOperation) bool {
+	var operations, _ = op.Payload["Operations"].([]any)
+	for _, o := range operations {
+		var pop, ok = o.(map[string]any)
+		if !ok {
+			continue
+		}
+		var value = pop["value"]
+		if path, _ := pop["path"].(string); len(path) > 0 {
+			if path != "active" {
+				continue
+			}
+		} else if values, ok := value.(map[string]any); ok {
+			value = values["active"]
+		}
+		if active, ok := value.(bool); ok && !active {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDeletionLimit aborts the sync if the plan removes too many Keeper users or teams
+func (s *sync) checkDeletionLimit(plan *SyncPlan) (err error) {
+	if s.deletionLimit <= 0 && s.deletionLimitPercent <= 0 {
+		return
+	}
+	var pending = make(map[ResourceType]int)
+	for _, op := range plan.Operations {
+		if len(op.SkipReason) > 0 {
+			continue
+		}
+		if op.Kind == DeleteOperation || op.Kind == DeactivateOperation || deactivates(op) {
+			pending[op.ResourceType]++
+		}
+	}
+	var total = map[ResourceType]int{
+		UsersResource:  len(plan.Users),
+		GroupsResource: len(plan.Groups),
+	}
+	for _, resourceType := range []ResourceType{UsersResource, GroupsResource} {
+		var number = pending[resourceType]
+		if number == 0 {
+			continue
+		}
+		if s.deletionLimit > 0 && number > int(s.deletionLimit) {
+			err = fmt.Errorf("sync aborted: %d %s(s) are about to be removed while \"Deletion Limit\" is %d",
+				number, resourceType.noun(), s.deletionLimit)
+			return
+		}
+		if s.deletionLimitPercent > 0 && number*100 > int(s.deletionLimitPercent)*total[resourceType] {
+			err = fmt.Errorf("sync aborted: %d out of %d %s(s) are about to be removed while \"Deletion Limit\" is %d%%",
+				number, total[resourceType], resourceType.noun(), s.deletionLimitPercent)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,248 @@
+package scim
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCheckDeletionLimit(t *testing.T) {
+	var deactivate = map[string]any{"Operations": []any{
+		map[string]any{"op": "replace", "value": map[string]any{"active": false, "displayName": "Alice"}}}}
+	var deactivatePath = map[string]any{"Operations": []any{
+		map[string]any{"op": "replace", "path": "active", "value": false}}}
+	var rename = map[string]any{"Operations": []any{
+		map[string]any{"op": "replace", "value": map[string]any{"displayName": "Alice"}}}}
+	var tests = []struct {
+		name       string
+		count      int32
+		percent    int32
+		operations []*PlannedOperation
+		aborted    bool
+	}{
+		{
+			name:  "no limit",
+			count: 0,
+			operations: []*PlannedOperation{
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+			},
+		},
+		{
+			name:  "deletes within the limit",
+			count: 2,
+			operations: []*PlannedOperation{
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+				{Kind: DeleteOperation, ResourceType: GroupsResource},
+				{Kind: DeleteOperation, ResourceType: GroupsResource},
+			},
+		},
+		{
+			name:  "deletes and deactivations over the limit",
+			count: 1,
+			operations: []*PlannedOperation{
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+				{Kind: DeactivateOperation, ResourceType: UsersResource},
+			},
+			aborted: true,
+		},
+		{
+			name:  "skipped operations are not counted",
+			count: 1,
+			operations: []*PlannedOperation{
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+				{Kind: DeleteOperation, ResourceType: UsersResource, SkipReason: "skipped"},
+			},
+		},
+		{
+			name:  "updates suspending users are counted",
+			count: 1,
+			operations: []*PlannedOperation{
+				{Kind: UpdateOperation, ResourceType: UsersResource, Payload: deactivate},
+				{Kind: UpdateOperation, ResourceType: UsersResource, Payload: deactivatePath},
+			},
+			aborted: true,
+		},
+		{
+			name:  "other updates are not counted",
+			count: 1,
+			operations: []*PlannedOperation{
+				{Kind: UpdateOperation, ResourceType: UsersResource, Payload: deactivate},
+				{Kind: UpdateOperation, ResourceType: UsersResource, Payload: rename},
+			},
+		},
+		{
+			name:    "percentage over the limit",
+			percent: 25,
+			operations: []*PlannedOperation{
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+			},
+			aborted: true,
+		},
+		{
+			name:    "percentage within the limit",
+			percent: 50,
+			operations: []*PlannedOperation{
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+				{Kind: DeleteOperation, ResourceType: UsersResource},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s = &sync{deletionLimit: tt.count, deletionLimitPercent: tt.percent}
+			var plan = &SyncPlan{
+				Operations: tt.operations,
+				Users:      make([]*ScimResourceState, 4),
+				Groups:     make([]*ScimResourceState, 4),
+			}
+			var err = s.checkDeletionLimit(plan)
+			if aborted := err != nil; aborted != tt.aborted {
+				t.Errorf("aborted: %t, expected: %t (%v)", aborted, tt.aborted, err)
+			}
+		})
+	}
+}
+
+func TestDeletionLimitCountsSuspendedUsers(t *testing.T) {
+	var source = &testSource{users: []*User{
+		{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com"},
+		{Id: "u2", Email: "bob@company.com", FullName: "bob@company.com"},
+	}}
+	var s = newTestSync(t, source, newTestScim([]map[string]any{
+		scimUserObject("k1", "alice@company.com", "u1"),
+		scimUserObject("k2", "bob@company.com", "u2"),
+	}, nil))
+	s.SetDeletionLimit(1, 0)
+	var plan = new(SyncPlan)
+	plan.Users, plan.Groups = s.snapshotScim()
+	if err := s.planUsers(plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkDeletionLimit(plan); err == nil {
+		t.Errorf("sync is not aborted: %v", describeOperations(plan.Operations))
+	}
+}
+
+func TestExecutePlanBatching(t *testing.T) {
+	var source = &testSource{
+		groups: []*Group{
+			{Id: "g1", Name: "Engineering"},
+			{Id: "g2", Name: "Marketing"},
+		},
+		users: []*User{
+			{Id: "u1", Email: "alice@company.com", FullName: "Alice", Active: true, Groups: []string{"g1", "g2"}},
+			{Id: "u2", Email: "bob@company.com", FullName: "Bob", Active: true, Groups: []string{"g1"}},
+			{Id: "u3", Email: "carol@company.com", FullName: "Carol", Active: true, Groups: []string{"g2"}},
+		},
+	}
+	var tests = []struct {
+		name        string
+		parallelism int32
+	}{
+		{name: "sequential", parallelism: 1},
+		{name: "parallel", parallelism: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var server = newTestScim([]map[string]any{
+				scimUserObject("k3", "carol@company.com", "u3"),
+			}, nil)
+			var s = newTestSync(t, source, server)
+			s.parallelism = tt.parallelism
+			var plan = new(SyncPlan)
+			if err := s.planGroups(plan); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.planUsers(plan); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.planMembership(plan); err != nil {
+				t.Fatal(err)
+			}
+			var checkpoint = new(SyncCheckpoint)
+			var stat = s.executePlan(context.Background(), plan, checkpoint)
+			for _, record := range stat.Records {
+				if record.Failed() {
+					t.Errorf("%s failed: %s", record.String(), record.Error)
+				}
+			}
+			if stat.Incomplete || len(checkpoint.Done) != len(plan.Operations) {
+				t.Errorf("%d of %d operation(s) were executed", len(checkpoint.Done), len(plan.Operations))
+			}
+
+			// a created resource is modified only after the POST has completed
+			var created = make(map[string]int)
+			for i, request := range server.requests {
+				var method, path, _ = strings.Cut(request, " ")
+				var _, keeperId, _ = strings.Cut(path, "/")
+				if isPendingKeeperId(keeperId) {
+					t.Errorf("request \"%s\" refers to a pending resource", request)
+				}
+				if method == "POST" {
+					created[keeperId] = i
+				} else if n, ok := created[keeperId]; ok && n > i {
+					t.Errorf("request \"%s\" was sent before the resource was created", request)
+				}
+			}
+			if len(checkpoint.Resolved) != 4 {
+				t.Errorf("resolved: %v", checkpoint.Resolved)
+			}
+
+			var membership = make(map[string]int)
+			for _, user := range server.users {
+				var groups, _ = user["groups"].([]any)
+				membership[user["userName"].(string)] = len(groups)
+			}
+			var expected = map[string]int{"alice@company.com": 2, "bob@company.com": 1, "carol@company.com": 1}
+			for email, count := range expected {
+				if membership[email] != count {
+					t.Errorf("%s is a member of %d team(s), expected %d", email, membership[email], count)
+				}
+			}
+		})
+	}
+}
+
+func TestExecutePlanResume(t *testing.T) {
+	var server = newTestScim(
+		[]map[string]any{scimUserObject("k1", "alice@company.com", "u1")},
+		[]map[string]any{scimGroupObject("t1", "Engineering", "g1")})
+	var s = newTestSync(t, &testSource{}, server)
+	var groupId = PendingKeeperId(GroupsResource, "g1")
+	var plan = &SyncPlan{
+		Operations: []*PlannedOperation{
+			{Kind: CreateOperation, ResourceType: GroupsResource, Name: "Engineering", KeeperId: groupId, GoogleId: "g1",
+				Method: "POST", Payload: map[string]any{"displayName": "Engineering", "externalId": "g1"}},
+			{Kind: CreateOperation, ResourceType: GroupsResource, Name: "Marketing", KeeperId: PendingKeeperId(GroupsResource, "g2"),
+				GoogleId: "g2", Method: "POST", Payload: map[string]any{"displayName": "Marketing", "externalId": "g2"}},
+			{Kind: MembershipOperation, ResourceType: UsersResource, Name: "alice@company.com", KeeperId: "k1", GoogleId: "u1",
+				Method: "PATCH", Payload: map[string]any{"Operations": []any{map[string]any{
+					"op": "add", "path": "groups", "value": []any{map[string]any{"value": groupId}}}}}},
+		},
+	}
+	var checkpoint = &SyncCheckpoint{
+		Done:     []int{0},
+		Resolved: map[string]string{groupId: "t1"},
+	}
+	var stat = s.executePlan(context.Background(), plan, checkpoint)
+	if !stat.Resumed || stat.Incomplete {
+		t.Errorf("resumed: %t, incomplete: %t", stat.Resumed, stat.Incomplete)
+	}
+	if len(stat.Records) != 2 {
+		t.Errorf("%d operation(s) were executed, expected 2", len(stat.Records))
+	}
+	for _, record := range stat.Records {
+		if record.Failed() {
+			t.Errorf("%s failed: %s", record.String(), record.Error)
+		}
+	}
+	var expected = []string{"GET Groups", "GET Users", "POST Groups/groups-1", "PATCH Users/k1"}
+	if strings.Join(server.requests, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("requests: %v, expected: %v", server.requests, expected)
+	}
+	if groups, _ := server.users["k1"]["groups"].([]any); len(groups) != 1 {
+		t.Errorf("membership: %v", groups)
+	}
+}
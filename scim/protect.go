@@ -0,0 +1,114 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/text/cases"
+	"strings"
+)
+
+// ProtectedMarker is a Keeper user attribute that protects the user from deactivation and deletion
+type ProtectedMarker struct {
+	// Attribute is the SCIM attribute path, e.g. "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:costCenter"
+	Attribute string
+	// Value is the attribute value that marks the user. An empty value marks users with a true boolean attribute
+	Value string
+}
+
+// ParseProtectedMarker parses the "Protected Marker" content: "<SCIM attribute>" or "<SCIM attribute> = <value>"
+func ParseProtectedMarker(value string) (marker *ProtectedMarker, err error) {
+	var attribute, markerValue, _ = strings.Cut(strings.TrimSpace(value), "=")
+	marker = &ProtectedMarker{
+		Attribute: strings.TrimSpace(attribute),
+		Value:     strings.TrimSpace(markerValue),
+	}
+	if len(marker.Attribute) == 0 {
+		err = fmt.Errorf("invalid protected marker \"%s\": expected \"<SCIM attribute> = <value>\"", value)
+		marker = nil
+	}
+	return
+}
+
+// Matches checks if a Keeper user is marked as protected
+func (pm *ProtectedMarker) Matches(resource map[string]any) bool {
+	if resource == nil {
+		return false
+	}
+	var value = getScimAttribute(resource, pm.Attribute)
+	if value == nil {
+		return false
+	}
+	if len(pm.Value) == 0 {
+		var bv, ok = toBoolean(value)
+		return ok && bv
+	}
+	if sv, ok := value.(string); ok {
+		return strings.EqualFold(sv, pm.Value)
+	}
+	return strings.EqualFold(fmt.Sprint(value), pm.Value)
+}
+
+func (pm *ProtectedMarker) String() string {
+	if len(pm.Value) == 0 {
+		return pm.Attribute
+	}
+	return fmt.Sprintf("%s = %s", pm.Attribute, pm.Value)
+}
+
+// ParseProtectedAttribute validates the "Protected Attribute" content: a boolean Google user field,
+// e.g. "customSchemas.Legal.Hold"
+func ParseProtectedAttribute(value string) (attribute string, err error) {
+	attribute = strings.TrimSpace(value)
+	if _, err = parseSourcePath(attribute); err != nil {
+		err = fmt.Errorf("invalid protected attribute \"%s\": %s", value, err.Error())
+	}
+	return
+}
+
+// isProtectedGoogleUser checks the protected attribute of a Google user
+func isProtectedGoogleUser(user *User, googleUser any, attribute string, logger SyncDebugLogger) bool {
+	var data, err = json.Marshal(googleUser)
+	if err != nil {
+		return false
+	}
+	var jo map[string]any
+	if err = json.Unmarshal(data, &jo); err != nil {
+		return false
+	}
+	var value = normalizeAttributeValue(resolveSourceValue(jo, attribute))
+	if value == nil {
+		return false
+	}
+	var bv, ok = toBoolean(value)
+	if !ok {
+		logger(fmt.Sprintf("User \"%s\": field \"%s\" is not boolean", user.Email, attribute))
+	}
+	return ok && bv
+}
+
+// buildProtection collects Google users protected from deprovisioning, including users outside the SCIM scope
+func (s *sync) buildProtection() {
+	s.protectedUsers = NewSet[string]()
+	s.source.ProtectedUsers(func(user *User) {
+		s.protectedUsers.Add(user.Id)
+		s.protectedUsers.Add(s.userKey(user.Email))
+	})
+}
+
+// protectionOf returns the reason a Keeper user cannot be deactivated or deleted. user is the matched Google user, can be nil
+func (s *sync) protectionOf(keeperUser *scimUser, user *User) string {
+	if user != nil && user.Protected {
+		return "user is protected in Google"
+	}
+	if keeperUser == nil {
+		return ""
+	}
+	if s.protectedUsers != nil &&
+		(s.protectedUsers.Has(keeperUser.ExternalId) || s.protectedUsers.Has(cases.Fold().String(keeperUser.Email))) {
+		return "user is protected in Google"
+	}
+	if s.protectedMarker != nil && s.protectedMarker.Matches(keeperUser.Resource) {
+		return fmt.Sprintf("user is protected by the Keeper marker \"%s\"", s.protectedMarker.String())
+	}
+	return ""
+}
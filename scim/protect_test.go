@@ -0,0 +1,169 @@
+package scim
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+const testCostCenter = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:costCenter"
+
+func TestParseProtectedMarker(t *testing.T) {
+	var tests = []struct {
+		value    string
+		expected *ProtectedMarker
+	}{
+		{value: "title", expected: &ProtectedMarker{Attribute: "title"}},
+		{value: " " + testCostCenter + " = Legal Hold ", expected: &ProtectedMarker{Attribute: testCostCenter, Value: "Legal Hold"}},
+		{value: "= Legal", expected: nil},
+		{value: "  ", expected: nil},
+	}
+	for _, tt := range tests {
+		var marker, err = ParseProtectedMarker(tt.value)
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("\"%s\": expected error", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("\"%s\": %s", tt.value, err.Error())
+		} else if !reflect.DeepEqual(marker, tt.expected) {
+			t.Errorf("\"%s\": %v, expected %v", tt.value, marker, tt.expected)
+		}
+	}
+}
+
+func TestProtectedMarkerMatches(t *testing.T) {
+	var flag = &ProtectedMarker{Attribute: "urn:custom:Protected"}
+	var costCenter = &ProtectedMarker{Attribute: testCostCenter, Value: "legal"}
+	var tests = []struct {
+		marker   *ProtectedMarker
+		resource map[string]any
+		expected bool
+	}{
+		{marker: flag, resource: map[string]any{"urn:custom": map[string]any{"Protected": true}}, expected: true},
+		{marker: flag, resource: map[string]any{"urn:custom": map[string]any{"Protected": "true"}}, expected: true},
+		{marker: flag, resource: map[string]any{"urn:custom": map[string]any{"Protected": false}}, expected: false},
+		{marker: flag, resource: map[string]any{"urn:custom": map[string]any{"Protected": "yes please"}}, expected: false},
+		{marker: flag, resource: map[string]any{}, expected: false},
+		{marker: flag, resource: nil, expected: false},
+		{marker: costCenter, resource: map[string]any{
+			"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": map[string]any{"costCenter": "Legal"}}, expected: true},
+		{marker: costCenter, resource: map[string]any{
+			"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": map[string]any{"costCenter": "Sales"}}, expected: false},
+	}
+	for _, tt := range tests {
+		if actual := tt.marker.Matches(tt.resource); actual != tt.expected {
+			t.Errorf("\"%s\" %v: %t, expected %t", tt.marker.String(), tt.resource, actual, tt.expected)
+		}
+	}
+}
+
+func TestParseProtectedAttribute(t *testing.T) {
+	var tests = []struct {
+		value    string
+		expected string
+		fails    bool
+	}{
+		{value: " customSchemas.Legal.Hold ", expected: "customSchemas.Legal.Hold"},
+		{value: "suspended", expected: "suspended"},
+		{value: "customSchemas..Hold", fails: true},
+	}
+	for _, tt := range tests {
+		var attribute, err = ParseProtectedAttribute(tt.value)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("\"%s\": expected error", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("\"%s\": %s", tt.value, err.Error())
+		} else if attribute != tt.expected {
+			t.Errorf("\"%s\": \"%s\", expected \"%s\"", tt.value, attribute, tt.expected)
+		}
+	}
+}
+
+// markScimUser sets the cost center of a Keeper user
+func markScimUser(user map[string]any, costCenter string) map[string]any {
+	user["urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"] = map[string]any{"costCenter": costCenter}
+	return user
+}
+
+func TestPlanProtectedUsers(t *testing.T) {
+	var source = &testSource{users: []*User{
+		{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true},
+		{Id: "u2", Email: "bob@company.com", FullName: "bob@company.com", Active: false, Protected: true},
+	}}
+	var server = newTestScim([]map[string]any{
+		scimUserObject("k1", "alice@company.com", "u1"),
+		scimUserObject("k2", "bob@company.com", "u2"),
+		markScimUser(scimUserObject("k3", "carol@company.com", "u3"), "Legal"),
+		markScimUser(scimUserObject("k4", "dave@company.com", "u4"), "Sales"),
+	}, nil)
+	var s = newTestSync(t, source, server)
+	s.SetProtectedMarker(&ProtectedMarker{Attribute: testCostCenter, Value: "Legal"})
+
+	var plan = &SyncPlan{}
+	s.planUsers(plan)
+	var expected = []string{"deactivate PATCH k2 (skipped)", "delete DELETE k3 (skipped)", "delete DELETE k4"}
+	if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("operations: %v, expected: %v", actual, expected)
+	}
+	for _, op := range plan.Operations {
+		if len(op.SkipReason) > 0 && op.Payload != nil {
+			t.Errorf("%s %s: blocked operation has payload", op.Kind, op.KeeperId)
+		}
+	}
+}
+
+func TestApplyRechecksProtection(t *testing.T) {
+	var source = &testSource{users: []*User{
+		{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: false},
+	}}
+	var server = newTestScim([]map[string]any{
+		scimUserObject("k1", "alice@company.com", "u1"),
+		scimUserObject("k2", "bob@company.com", "u2"),
+		scimUserObject("k3", "carol@company.com", "u3"),
+	}, nil)
+	var newSync = func() *sync {
+		var s = newScimSync(t, source, server)
+		s.SetProtectedMarker(&ProtectedMarker{Attribute: testCostCenter, Value: "Legal"})
+		return s
+	}
+
+	var plan, err = newSync().Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var planned = describeOperations(plan.Operations)
+	var expected = []string{"update PATCH k1", "delete DELETE k2", "delete DELETE k3"}
+	if !reflect.DeepEqual(planned, expected) {
+		t.Fatalf("plan: %v, expected: %v", planned, expected)
+	}
+
+	// k1 and k2 are protected after the plan is approved
+	markScimUser(server.users["k1"], "Legal")
+	markScimUser(server.users["k2"], "Legal")
+	var stat *SyncStat
+	if stat, err = newSync().Apply(context.Background(), plan); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Users.Deleted != 1 {
+		t.Errorf("%d user(s) deleted", stat.Users.Deleted)
+	}
+	if _, ok := server.users["k2"]; !ok {
+		t.Error("protected user is deleted")
+	}
+	if _, ok := server.users["k3"]; ok {
+		t.Error("user is not deleted")
+	}
+	if active, _ := server.users["k1"]["active"].(bool); !active {
+		t.Error("protected user is deactivated")
+	}
+	if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, planned) {
+		t.Errorf("Apply modifies the plan: %v", actual)
+	}
+}
@@ -0,0 +1,112 @@
+package scim
+
+import (
+	"context"
+	"fmt"
+	admin "google.golang.org/api/admin/directory/v1"
+	"strings"
+)
+
+type UserQueryMode string
+
+const (
+	// IncludeQuery adds matching users to the SCIM scope
+	IncludeQuery UserQueryMode = "include"
+	// RestrictQuery keeps only matching users in the SCIM scope
+	RestrictQuery UserQueryMode = "restrict"
+	// ExcludeQuery removes matching users from the SCIM scope
+	ExcludeQuery UserQueryMode = "exclude"
+)
+
+// UserQuery is a Google Directory API user query that widens or narrows the SCIM scope
+type UserQuery struct {
+	Mode  UserQueryMode
+	Query string
+}
+
+// ParseUserQueries parses the "SCIM Query" content. One query per line, optionally prefixed by the mode:
+// "include <query>" (default), "restrict <query>" or "exclude <query>", e.g. "exclude orgUnitPath='/Contractors'"
+func ParseUserQueries(value string) (queries []*UserQuery, err error) {
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var query = &UserQuery{
+			Mode:  IncludeQuery,
+			Query: line,
+		}
+		var mode, rest, _ = strings.Cut(line, " ")
+		switch UserQueryMode(strings.ToLower(mode)) {
+		case IncludeQuery, RestrictQuery, ExcludeQuery:
+			query.Mode = UserQueryMode(strings.ToLower(mode))
+			query.Query = strings.TrimSpace(rest)
+		}
+		if len(query.Query) == 0 {
+			err = fmt.Errorf("invalid user query \"%s\": query cannot be empty", line)
+			return
+		}
+		queries = append(queries, query)
+	}
+	return
+}
+
+// hasIncludeQueries checks if the queries may add users to the SCIM scope
+func hasIncludeQueries(queries []*UserQuery) bool {
+	for _, q := range queries {
+		if q.Mode == IncludeQuery {
+			return true
+		}
+	}
+	return false
+}
+
+// applyUserQueries combines users of the SCIM groups with the query results
+// Include queries are applied first, then restrict queries, then exclude queries
+func (ge *googleEndpoint) applyUserQueries(ctx context.Context, directory *admin.Service, userLookup map[string]*User) (err error) {
+	for _, mode := range []UserQueryMode{IncludeQuery, RestrictQuery, ExcludeQuery} {
+		for _, q := range ge.queries {
+			if q.Mode != mode {
+				continue
+			}
+			var matched = NewSet[string]()
+			if err = directory.Users.List().Customer("my_customer").Projection(ge.projection()).Query(q.Query).MaxResults(200).
+				Pages(ctx, func(users *admin.Users) error {
+					for _, u := range users.Users {
+						matched.Add(u.Id)
+						if _, ok := userLookup[u.Id]; !ok {
+							userLookup[u.Id] = ge.parseUser(u)
+						}
+					}
+					return nil
+				}); err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				} else {
+					err = fmt.Errorf("google directory API: error querying users \"%s\": %s", q.Query, err.Error())
+				}
+				return
+			}
+			ge.DebugLogger()(fmt.Sprintf("User query \"%s\" (%s) matches %d user(s)", q.Query, q.Mode, len(matched)))
+			switch q.Mode {
+			case IncludeQuery:
+				for userId := range matched {
+					if _, ok := ge.users[userId]; !ok {
+						ge.users[userId] = userLookup[userId]
+					}
+				}
+			case RestrictQuery:
+				for userId := range ge.users {
+					if !matched.Has(userId) {
+						delete(ge.users, userId)
+					}
+				}
+			case ExcludeQuery:
+				for userId := range matched {
+					delete(ge.users, userId)
+				}
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package scim
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/cases"
+	"regexp"
+	"strings"
+)
+
+type EmailRewriteKind string
+
+const (
+	LowercaseRewrite EmailRewriteKind = "lowercase"
+	DomainRewrite    EmailRewriteKind = "domain"
+	RegexRewrite     EmailRewriteKind = "regex"
+)
+
+// EmailRewriteRule transforms Google user email into Keeper username
+// Rules are created with NewEmailRewriteRule or ParseEmailRewriteRules
+type EmailRewriteRule struct {
+	Kind EmailRewriteKind
+	// Pattern is the Google email domain for DomainRewrite or the regular expression for RegexRewrite
+	Pattern string
+	// Replacement is Keeper email domain for DomainRewrite or the regular expression replacement for RegexRewrite
+	Replacement string
+	regex       *regexp.Regexp
+}
+
+// NewEmailRewriteRule creates a validated email rewrite rule
+// pattern and replacement are ignored for LowercaseRewrite
+func NewEmailRewriteRule(kind EmailRewriteKind, pattern string, replacement string) (rule *EmailRewriteRule, err error) {
+	var r = &EmailRewriteRule{
+		Kind: kind,
+	}
+	switch kind {
+	case LowercaseRewrite:
+	case DomainRewrite:
+		r.Pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "@")
+		r.Replacement = strings.TrimPrefix(strings.TrimSpace(replacement), "@")
+		if len(r.Pattern) == 0 || len(r.Replacement) == 0 {
+			err = errors.New("domain cannot be empty")
+			return
+		}
+	case RegexRewrite:
+		r.Pattern = strings.TrimSpace(pattern)
+		r.Replacement = strings.TrimSpace(replacement)
+		if r.regex, err = regexp.Compile(r.Pattern); err != nil {
+			return
+		}
+	default:
+		err = errors.New("supported rules are \"lowercase\", \"domain\" and \"regex\"")
+		return
+	}
+	rule = r
+	return
+}
+
+// ParseEmailRewriteRules parses the "Email Rewrite" content. One rule per line:
+// "lowercase", "domain <Google domain> => <Keeper domain>" or "regex <pattern> => <replacement>"
+// Rules are applied in order
+func ParseEmailRewriteRules(value string) (rules []*EmailRewriteRule, err error) {
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var kind, args, _ = strings.Cut(line, " ")
+		var ruleKind = EmailRewriteKind(strings.ToLower(kind))
+		var pattern, replacement string
+		if ruleKind != LowercaseRewrite {
+			var ok bool
+			if pattern, replacement, ok = strings.Cut(args, "=>"); !ok {
+				err = fmt.Errorf("invalid email rewrite rule \"%s\": expected \"%s <pattern> => <replacement>\"", line, kind)
+				return
+			}
+		}
+		var rule *EmailRewriteRule
+		if rule, err = NewEmailRewriteRule(ruleKind, pattern, replacement); err != nil {
+			err = fmt.Errorf("invalid email rewrite rule \"%s\": %s", line, err.Error())
+			return
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+// Rewrite applies the rule to an email. A regex rule that was not created by NewEmailRewriteRule leaves the email unchanged
+func (r *EmailRewriteRule) Rewrite(email string) string {
+	switch r.Kind {
+	case LowercaseRewrite:
+		return strings.ToLower(email)
+	case DomainRewrite:
+		if pos := strings.LastIndex(email, "@"); pos >= 0 && strings.EqualFold(email[pos+1:], r.Pattern) {
+			return email[:pos+1] + r.Replacement
+		}
+	case RegexRewrite:
+		if r.regex != nil {
+			return r.regex.ReplaceAllString(email, r.Replacement)
+		}
+	}
+	return email
+}
+
+// keeperEmail returns the Keeper username for a Google user email
+func (s *sync) keeperEmail(email string) string {
+	for _, rule := range s.emailRewrite {
+		email = rule.Rewrite(email)
+	}
+	return email
+}
+
+// userKey returns the key Keeper users are looked up by for a Google user email
+func (s *sync) userKey(email string) string {
+	return cases.Fold().String(s.keeperEmail(email))
+}
@@ -0,0 +1,66 @@
+package scim
+
+import (
+	"testing"
+)
+
+func TestParseEmailRewriteRules(t *testing.T) {
+	var rules, err = ParseEmailRewriteRules(`
+# comment
+domain @old.com => @new.com
+regex ^([a-z]+)\.([a-z]+)@ => ${1}_${2}@
+LOWERCASE
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("%d rule(s) parsed", len(rules))
+	}
+	var s = &sync{emailRewrite: rules}
+	var tests = []struct {
+		email    string
+		expected string
+	}{
+		{email: "john.doe@old.com", expected: "john_doe@new.com"},
+		{email: "John.Doe@OLD.COM", expected: "john.doe@new.com"},
+		{email: "jane@other.com", expected: "jane@other.com"},
+		{email: "jane.roe@Other.com", expected: "jane_roe@other.com"},
+	}
+	for _, tt := range tests {
+		if actual := s.keeperEmail(tt.email); actual != tt.expected {
+			t.Errorf("\"%s\": \"%s\", expected: \"%s\"", tt.email, actual, tt.expected)
+		}
+	}
+
+	for _, value := range []string{
+		"domain old.com",
+		"domain => new.com",
+		"domain old.com =>",
+		"regex ([a-z => x",
+		"uppercase",
+		"suffix a => b",
+	} {
+		if _, err = ParseEmailRewriteRules(value); err == nil {
+			t.Errorf("\"%s\" is accepted", value)
+		}
+	}
+}
+
+func TestNewEmailRewriteRule(t *testing.T) {
+	if _, err := NewEmailRewriteRule(RegexRewrite, "(", "x"); err == nil {
+		t.Error("invalid regular expression is accepted")
+	}
+	var rule, err = NewEmailRewriteRule(DomainRewrite, "@old.com", "new.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Pattern != "old.com" || rule.Replacement != "new.com" {
+		t.Errorf("rule: %+v", rule)
+	}
+	// a rule that bypassed the constructor must not panic
+	var bad = &EmailRewriteRule{Kind: RegexRewrite, Pattern: "(", Replacement: "x"}
+	if actual := bad.Rewrite("john@company.com"); actual != "john@company.com" {
+		t.Errorf("rewritten to \"%s\"", actual)
+	}
+}
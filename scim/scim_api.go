@@ -2,6 +2,7 @@ package scim
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,11 +10,15 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type scimUser struct {
 	User
-	ExternalId string
+	ExternalId   string
+	LastModified time.Time
+	// Resource is SCIM user object as returned by SCIM endpoint
+	Resource map[string]any
 }
 
 type scimGroup struct {
@@ -48,6 +53,7 @@ func parseScimUser(userObject map[string]any) (result *scimUser) {
 	result = new(scimUser)
 	result.Id = userId
 	result.Email = email
+	result.Resource = userObject
 	result.Active, _ = toBoolean(userObject["active"])
 	result.ExternalId, _ = toString(userObject["externalId"])
 	result.FullName, _ = toString(userObject["displayName"])
@@ -59,6 +65,14 @@ func parseScimUser(userObject map[string]any) (result *scimUser) {
 			result.LastName, _ = toString(jo["familyName"])
 		}
 	}
+	if j = userObject["meta"]; j != nil {
+		if jo, ok = j.(map[string]any); ok {
+			var lastModified string
+			if lastModified, ok = toString(jo["lastModified"]); ok {
+				result.LastModified, _ = time.Parse(time.RFC3339, lastModified)
+			}
+		}
+	}
 	if j = userObject["groups"]; j != nil {
 		var ja []any
 		if ja, ok = j.([]any); ok {
@@ -75,9 +89,9 @@ func parseScimUser(userObject map[string]any) (result *scimUser) {
 	return
 }
 
-func (s *sync) populateScim() (err error) {
+func (s *sync) populateScim(ctx context.Context) (err error) {
 	s.scimGroups = make(map[string]*scimGroup)
-	if err = s.getResources("Groups", func(ro map[string]any) {
+	if err = s.getResources(ctx, "Groups", func(ro map[string]any) {
 		if g := parseScimGroup(ro); g != nil {
 			s.scimGroups[g.Id] = g
 		}
@@ -86,7 +100,7 @@ func (s *sync) populateScim() (err error) {
 	}
 
 	s.scimUsers = make(map[string]*scimUser)
-	if err = s.getResources("Users", func(ro map[string]any) {
+	if err = s.getResources(ctx, "Users", func(ro map[string]any) {
 		if user := parseScimUser(ro); user != nil {
 			s.scimUsers[user.Id] = user
 		}
@@ -148,7 +162,7 @@ func (s *sync) executeRequest(rq *http.Request) (response map[string]any, err er
 	return
 }
 
-func (s *sync) patchResource(resourceType string, resourceId string, payload any) (err error) {
+func (s *sync) patchResource(ctx context.Context, resourceType string, resourceId string, payload any) (err error) {
 	var uri *url.URL
 	if uri, err = s.composeUrl(resourceType, resourceId); err != nil {
 		return
@@ -160,7 +174,7 @@ func (s *sync) patchResource(resourceType string, resourceId string, payload any
 	}
 
 	var rq *http.Request
-	if rq, err = http.NewRequest("PATCH", uri.String(), bytes.NewBuffer(data)); err != nil {
+	if rq, err = http.NewRequestWithContext(ctx, "PATCH", uri.String(), bytes.NewBuffer(data)); err != nil {
 		return
 	}
 	rq.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.token))
@@ -170,7 +184,7 @@ func (s *sync) patchResource(resourceType string, resourceId string, payload any
 	return
 }
 
-func (s *sync) postResource(resourceType string, payload any) (resource map[string]any, err error) {
+func (s *sync) postResource(ctx context.Context, resourceType string, payload any) (resource map[string]any, err error) {
 	var uri *url.URL
 	if uri, err = s.composeUrl(resourceType); err != nil {
 		return
@@ -182,7 +196,7 @@ func (s *sync) postResource(resourceType string, payload any) (resource map[stri
 	}
 
 	var rq *http.Request
-	if rq, err = http.NewRequest("POST", uri.String(), bytes.NewBuffer(data)); err != nil {
+	if rq, err = http.NewRequestWithContext(ctx, "POST", uri.String(), bytes.NewBuffer(data)); err != nil {
 		return
 	}
 	rq.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.token))
@@ -191,14 +205,14 @@ func (s *sync) postResource(resourceType string, payload any) (resource map[stri
 	return
 }
 
-func (s *sync) deleteResource(resourceType string, resourceId string) (err error) {
+func (s *sync) deleteResource(ctx context.Context, resourceType string, resourceId string) (err error) {
 	var uri *url.URL
 	if uri, err = s.composeUrl(resourceType, resourceId); err != nil {
 		return
 	}
 
 	var rq *http.Request
-	if rq, err = http.NewRequest("DELETE", uri.String(), nil); err != nil {
+	if rq, err = http.NewRequestWithContext(ctx, "DELETE", uri.String(), nil); err != nil {
 		return
 	}
 	rq.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.token))
@@ -207,7 +221,7 @@ func (s *sync) deleteResource(resourceType string, resourceId string) (err error
 	return
 }
 
-func (s *sync) getResources(resourceType string, cb func(map[string]any)) (err error) {
+func (s *sync) getResources(ctx context.Context, resourceType string, cb func(map[string]any)) (err error) {
 	var uri *url.URL
 	if uri, err = s.composeUrl(resourceType); err != nil {
 		return
@@ -228,7 +242,7 @@ func (s *sync) getResources(resourceType string, cb func(map[string]any)) (err e
 		ruri.Query().Add("count", strconv.Itoa(count))
 
 		var rq *http.Request
-		if rq, err = http.NewRequest("GET", ruri.String(), nil); err != nil {
+		if rq, err = http.NewRequestWithContext(ctx, "GET", ruri.String(), nil); err != nil {
 			return
 		}
 		rq.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.token))
@@ -1,5 +1,12 @@
 package scim
 
+import (
+	"context"
+	"io"
+	"text/template"
+	"time"
+)
+
 type SyncDebugLogger func(string)
 
 var NilLogger SyncDebugLogger = func(string) {}
@@ -7,27 +14,149 @@ var NilLogger SyncDebugLogger = func(string) {}
 type ICrmDataSource interface {
 	Users(func(*User))
 	Groups(func(*Group))
-	Populate() error
+	Populate(context.Context) error
 	DebugLogger() SyncDebugLogger
 	SetDebugLogger(SyncDebugLogger)
 	LoadErrors() bool
+	// Warnings returns source data problems found by Populate that do not prevent the sync
+	Warnings() []string
+	// ProtectedUsers enumerates protected users, including users outside the SCIM scope
+	ProtectedUsers(func(*User))
+}
+
+// SyncRecord is the outcome of a single planned SCIM operation
+type SyncRecord struct {
+	Kind         OperationKind `json:"kind"`
+	ResourceType ResourceType  `json:"resourceType"`
+	Name         string        `json:"name"`
+	GoogleId     string        `json:"googleId,omitempty"`
+	KeeperId     string        `json:"keeperId,omitempty"`
+	Attributes   []string      `json:"attributes,omitempty"`
+	Added        int           `json:"added,omitempty"`
+	Removed      int           `json:"removed,omitempty"`
+	SkipReason   string        `json:"skipReason,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Note         string        `json:"note,omitempty"`
+}
+
+type SyncCounters struct {
+	Created     int `json:"created"`
+	Updated     int `json:"updated"`
+	Deleted     int `json:"deleted"`
+	Deactivated int `json:"deactivated"`
+	Added       int `json:"added"`
+	Removed     int `json:"removed"`
+	Skipped     int `json:"skipped"`
+	Failed      int `json:"failed"`
 }
 
 type SyncStat struct {
-	SuccessUsers      []string
-	FailedUsers       []string
-	SuccessGroups     []string
-	FailedGroups      []string
-	SuccessMembership []string
-	FailedMembership  []string
+	// Incomplete is set when the sync stopped before all planned operations were started
+	Incomplete bool          `json:"incomplete,omitempty"`
+	Pending    int           `json:"pending,omitempty"`
+	Resumed    bool          `json:"resumed,omitempty"`
+	Warnings   []string      `json:"warnings,omitempty"`
+	Records    []*SyncRecord `json:"records"`
+	Users      SyncCounters  `json:"users"`
+	Groups     SyncCounters  `json:"groups"`
+	Membership SyncCounters  `json:"membership"`
 }
+type ResourceType string
+
+const (
+	UsersResource  ResourceType = "Users"
+	GroupsResource ResourceType = "Groups"
+)
+
+type OperationKind string
+
+const (
+	CreateOperation     OperationKind = "create"
+	UpdateOperation     OperationKind = "update"
+	DeleteOperation     OperationKind = "delete"
+	DeactivateOperation OperationKind = "deactivate"
+	MembershipOperation OperationKind = "membership"
+)
+
+// PlannedOperation is a single SCIM request computed by the sync planner.
+// KeeperId of a resource created earlier in the same plan is not known until the POST completes.
+// Such ids are written as pending references, see PendingKeeperId
+type PlannedOperation struct {
+	Kind         OperationKind  `json:"kind"`
+	ResourceType ResourceType   `json:"resourceType"`
+	Name         string         `json:"name"`
+	KeeperId     string         `json:"keeperId,omitempty"`
+	GoogleId     string         `json:"googleId,omitempty"`
+	Method       string         `json:"method"`
+	Attributes   []string       `json:"attributes,omitempty"`
+	Payload      map[string]any `json:"payload,omitempty"`
+	SkipReason   string         `json:"skipReason,omitempty"`
+	// Note explains how the operation was planned, e.g. how a Keeper user was matched
+	Note string `json:"note,omitempty"`
+}
+
+// ScimResourceState is a fingerprint of a Keeper SCIM resource the plan was computed against
+type ScimResourceState struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	ExternalId string `json:"externalId,omitempty"`
+	Hash       string `json:"hash"`
+}
+
+// SyncPlan is an ordered list of SCIM operations that brings Keeper in sync with the data source
+type SyncPlan struct {
+	Version     int                  `json:"version"`
+	ScimUrl     string               `json:"scimUrl"`
+	Created     time.Time            `json:"created"`
+	Incremental bool                 `json:"incremental,omitempty"`
+	Users       []*ScimResourceState `json:"users"`
+	Groups      []*ScimResourceState `json:"groups"`
+	Operations  []*PlannedOperation  `json:"operations"`
+	Warnings    []string             `json:"warnings,omitempty"`
+	// MissingSince holds grace period start times of Keeper users outside the SCIM scope. Keyed by Keeper user ID.
+	// The plan does not change the sync state. The times are stored when the plan is executed
+	MissingSince map[string]time.Time `json:"missingSince,omitempty"`
+}
+
 type IScimSync interface {
 	Source() ICrmDataSource
-	Sync() (*SyncStat, error)
+	Sync(context.Context) (*SyncStat, error)
+	Plan(context.Context) (*SyncPlan, error)
+	Apply(context.Context, *SyncPlan) (*SyncStat, error)
+	ExportPlan(*SyncPlan, io.Writer) error
+	ImportPlan(io.Reader) (*SyncPlan, error)
 	Verbose() bool
 	SetVerbose(bool)
 	Destructive() int32
 	SetDestructive(int32)
+	TeamNameTemplate() *template.Template
+	SetTeamNameTemplate(*template.Template)
+	TeamMapping() map[string]string
+	SetTeamMapping(map[string]string)
+	EmailRewrite() []*EmailRewriteRule
+	SetEmailRewrite([]*EmailRewriteRule)
+	Parallelism() int32
+	SetParallelism(int32)
+	Resume() bool
+	SetResume(bool)
+	RenameAliasMatches() bool
+	SetRenameAliasMatches(bool)
+	Exclusions() []*Exclusion
+	SetExclusions([]*Exclusion)
+	ProtectedMarker() *ProtectedMarker
+	SetProtectedMarker(*ProtectedMarker)
+	Incremental() (bool, time.Duration)
+	SetIncremental(bool, time.Duration)
+	GracePeriod() time.Duration
+	SetGracePeriod(time.Duration)
+	StateStore() IStateStore
+	SetStateStore(IStateStore)
+	Deprovision() DeprovisionPolicy
+	SetDeprovision(DeprovisionPolicy)
+	DeleteDeactivatedAfter() time.Duration
+	SetDeleteDeactivatedAfter(time.Duration)
+	DeletionLimit() (int32, int32)
+	SetDeletionLimit(int32, int32)
 }
 
 type User struct {
@@ -38,22 +167,61 @@ type User struct {
 	LastName  string
 	Active    bool
 	Groups    []string
+	// Aliases holds the user's alias and secondary email addresses
+	Aliases []string
+	// Manager is the email of the user's manager
+	Manager string
+	// Attributes holds mapped SCIM attribute values keyed by SCIM attribute path. nil value clears the attribute
+	Attributes map[string]any
+	// Protected users are never deactivated or deleted in Keeper
+	Protected bool
 }
 
 type Group struct {
-	Id   string
-	Name string
+	Id    string
+	Name  string
+	Email string
 }
 
+// DeprovisionPolicy controls what happens to Keeper users that are no longer in the SCIM scope
+type DeprovisionPolicy string
+
+const (
+	DeleteDeprovision     DeprovisionPolicy = "delete"
+	DeactivateDeprovision DeprovisionPolicy = "deactivate"
+)
+
 type ScimEndpointParameters struct {
-	Url         string
-	Token       string
-	Verbose     bool
-	Destructive int32
+	Url                    string
+	Token                  string
+	Verbose                bool
+	Destructive            int32
+	Parallelism            int32
+	EmailRewrite           []*EmailRewriteRule
+	TeamMapping            map[string]string
+	TeamNameTemplate       *template.Template
+	RenameAliasMatches     bool
+	Exclusions             []*Exclusion
+	ProtectedMarker        *ProtectedMarker
+	Resume                 bool
+	Incremental            bool
+	FullSyncInterval       time.Duration
+	GracePeriod            time.Duration
+	Deprovision            DeprovisionPolicy
+	DeleteDeactivatedAfter time.Duration
+	DeletionLimit          int32
+	DeletionLimitPercent   int32
 }
 
 type GoogleEndpointParameters struct {
-	AdminAccount string
-	Credentials  []byte
-	ScimGroups   []string
+	AdminAccount     string
+	Credentials      []byte
+	ScimGroups       []string
+	OrgUnits         []string
+	Queries          []*UserQuery
+	AttributeMapping []*AttributeMapping
+	NestedGroups     NestedGroupMode
+	NestedGroupDepth int
+	// ProtectedAttribute is a boolean Google user field that protects the user from deprovisioning
+	ProtectedAttribute string
 }
@@ -0,0 +1,162 @@
+package scim
+
+import (
+	"fmt"
+	"io"
+)
+
+func (r *SyncRecord) Skipped() bool {
+	return len(r.SkipReason) > 0
+}
+
+func (r *SyncRecord) Failed() bool {
+	return len(r.Error) > 0
+}
+
+func (r *SyncRecord) Success() bool {
+	return !r.Skipped() && !r.Failed()
+}
+
+func (r *SyncRecord) method() string {
+	switch r.Kind {
+	case CreateOperation:
+		return "POST"
+	case DeleteOperation:
+		return "DELETE"
+	}
+	return "PATCH"
+}
+
+// String renders the record as a human-readable message
+func (r *SyncRecord) String() string {
+	if len(r.Note) > 0 {
+		return fmt.Sprintf("%s (%s)", r.message(), r.Note)
+	}
+	return r.message()
+}
+
+func (r *SyncRecord) message() string {
+	var noun = r.ResourceType.noun()
+	if r.Skipped() {
+		if r.Kind == MembershipOperation {
+			return fmt.Sprintf("Membership for %s \"%s\": %s", noun, r.Name, r.SkipReason)
+		}
+		return fmt.Sprintf("%s %s \"%s\": %s", r.method(), noun, r.Name, r.SkipReason)
+	}
+	if r.Failed() {
+		if r.Kind == MembershipOperation {
+			return fmt.Sprintf("%s %s \"%s\" membership error: %s", r.method(), noun, r.Name, r.Error)
+		}
+		return fmt.Sprintf("%s %s \"%s\" error: %s", r.method(), noun, r.Name, r.Error)
+	}
+	switch r.Kind {
+	case CreateOperation:
+		return fmt.Sprintf("SCIM added %s \"%s\"", noun, r.Name)
+	case UpdateOperation:
+		return fmt.Sprintf("SCIM updated %s \"%s\"", noun, r.Name)
+	case DeleteOperation:
+		return fmt.Sprintf("SCIM deleted %s \"%s\"", noun, r.Name)
+	case DeactivateOperation:
+		return fmt.Sprintf("SCIM deactivated %s \"%s\"", noun, r.Name)
+	case MembershipOperation:
+		return fmt.Sprintf("SCIM changed %s \"%s\" membership: %d added; %d removed", noun, r.Name, r.Added, r.Removed)
+	}
+	return fmt.Sprintf("SCIM %s %s \"%s\"", r.Kind, noun, r.Name)
+}
+
+func (ss *SyncStat) counters(record *SyncRecord) *SyncCounters {
+	switch {
+	case record.Kind == MembershipOperation:
+		return &ss.Membership
+	case record.ResourceType == GroupsResource:
+		return &ss.Groups
+	}
+	return &ss.Users
+}
+
+func (ss *SyncStat) addRecord(record *SyncRecord) {
+	ss.Records = append(ss.Records, record)
+	var c = ss.counters(record)
+	switch {
+	case record.Skipped():
+		c.Skipped++
+	case record.Failed():
+		c.Failed++
+	default:
+		switch record.Kind {
+		case CreateOperation:
+			c.Created++
+		case UpdateOperation:
+			c.Updated++
+		case DeleteOperation:
+			c.Deleted++
+		case DeactivateOperation:
+			c.Deactivated++
+		case MembershipOperation:
+			c.Added += record.Added
+			c.Removed += record.Removed
+		}
+	}
+}
+
+// Filter returns records that satisfy the predicate
+func (ss *SyncStat) Filter(cb func(*SyncRecord) bool) (records []*SyncRecord) {
+	for _, r := range ss.Records {
+		if cb(r) {
+			records = append(records, r)
+		}
+	}
+	return
+}
+
+// Write prints sync records grouped by resource and outcome, followed by totals and warnings
+func (ss *SyncStat) Write(w io.Writer) {
+	if ss == nil {
+		return
+	}
+	var sections = []struct {
+		title   string
+		counter SyncCounters
+		filter  func(*SyncRecord) bool
+	}{
+		{"Group", ss.Groups, func(r *SyncRecord) bool {
+			return r.ResourceType == GroupsResource && r.Kind != MembershipOperation
+		}},
+		{"User", ss.Users, func(r *SyncRecord) bool {
+			return r.ResourceType == UsersResource && r.Kind != MembershipOperation
+		}},
+		{"Membership", ss.Membership, func(r *SyncRecord) bool {
+			return r.Kind == MembershipOperation
+		}},
+	}
+	for _, section := range sections {
+		var successes = ss.Filter(func(r *SyncRecord) bool { return section.filter(r) && r.Success() })
+		if len(successes) > 0 {
+			_, _ = fmt.Fprintf(w, "%s Success:\n", section.title)
+			for _, r := range successes {
+				_, _ = fmt.Fprintf(w, "\t%s\n", r.String())
+			}
+		}
+		var failures = ss.Filter(func(r *SyncRecord) bool { return section.filter(r) && !r.Success() })
+		if len(failures) > 0 {
+			_, _ = fmt.Fprintf(w, "%s Failure:\n", section.title)
+			for _, r := range failures {
+				_, _ = fmt.Fprintf(w, "\t%s\n", r.String())
+			}
+		}
+	}
+	for _, section := range sections {
+		var c = section.counter
+		_, _ = fmt.Fprintf(w, "%s Total: %d created; %d updated; %d deleted; %d deactivated; %d added; %d removed; %d skipped; %d failed\n",
+			section.title, c.Created, c.Updated, c.Deleted, c.Deactivated, c.Added, c.Removed, c.Skipped, c.Failed)
+	}
+	for _, warning := range ss.Warnings {
+		_, _ = fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+	if ss.Resumed {
+		_, _ = fmt.Fprintf(w, "Sync was resumed from the checkpoint\n")
+	}
+	if ss.Incomplete {
+		_, _ = fmt.Fprintf(w, "Sync is incomplete: %d operation(s) were not started\n", ss.Pending)
+	}
+}
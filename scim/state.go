@@ -0,0 +1,382 @@
+package scim
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"time"
+)
+
+// FailureHistory tracks consecutive failures of SCIM operations for a single resource
+type FailureHistory struct {
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	LastError string    `json:"lastError"`
+}
+
+// SyncCheckpoint is the progress of a sync run that stopped before all operations were started
+type SyncCheckpoint struct {
+	// SourceHash is the fingerprint of the source data the plan was computed from
+	SourceHash string    `json:"sourceHash"`
+	Created    time.Time `json:"created"`
+	Plan       *SyncPlan `json:"plan"`
+	// Done holds indexes of plan operations that were already executed
+	Done []int `json:"done,omitempty"`
+	// Resolved maps pending references to Keeper IDs of the resources created by the plan
+	Resolved map[string]string `json:"resolved,omitempty"`
+	// Incomplete holds Google user IDs whose operations failed or were skipped in the runs of this plan
+	Incomplete []string `json:"incomplete,omitempty"`
+}
+
+// SyncState is the data the sync keeps between runs
+type SyncState struct {
+	// MissingSince holds the time a Keeper user was first found outside the SCIM scope. Keyed by Keeper user ID
+	MissingSince map[string]time.Time `json:"missingSince,omitempty"`
+	// DeactivatedAt holds the time the sync deactivated a Keeper user. Keyed by Keeper user ID
+	DeactivatedAt map[string]time.Time `json:"deactivatedAt,omitempty"`
+	// UserLinks maps Google user ID to Keeper user ID
+	UserLinks map[string]string `json:"userLinks,omitempty"`
+	// GroupLinks maps Google group ID to Keeper team ID
+	GroupLinks map[string]string `json:"groupLinks,omitempty"`
+	// UserHashes holds the hash of Google user attributes and membership that were last synced successfully. Keyed by Google user ID
+	UserHashes map[string]string `json:"userHashes,omitempty"`
+	// Failures holds failure history. Keyed by resource type and Google or Keeper ID
+	Failures map[string]*FailureHistory `json:"failures,omitempty"`
+	// LastSync is the time the last sync run completed
+	LastSync time.Time `json:"lastSync,omitempty"`
+	// LastFullSync is the time the last sync run that compared all users completed
+	LastFullSync time.Time `json:"lastFullSync,omitempty"`
+	// Checkpoint is the progress of the last incomplete sync run
+	Checkpoint *SyncCheckpoint `json:"checkpoint,omitempty"`
+}
+
+// checkpointMaxAge is the age after which an incomplete run is planned again
+const checkpointMaxAge = 24 * time.Hour
+
+// IStateStore persists SyncState between sync runs
+type IStateStore interface {
+	Load() (*SyncState, error)
+	Save(*SyncState) error
+}
+
+// IStateSizeLimit is implemented by state stores that can hold a limited amount of data
+type IStateSizeLimit interface {
+	// MaxStateSize returns the maximum size of the serialized sync state in bytes
+	MaxStateSize() int
+}
+
+type memoryStateStore struct {
+	lock gosync.Mutex
+	data []byte
+}
+
+// NewMemoryStateStore creates IStateStore that keeps the sync state for the lifetime of the process
+func NewMemoryStateStore() IStateStore {
+	return new(memoryStateStore)
+}
+
+func (ms *memoryStateStore) Load() (state *SyncState, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	state = new(SyncState)
+	if len(ms.data) > 0 {
+		err = json.Unmarshal(ms.data, state)
+	}
+	return
+}
+
+func (ms *memoryStateStore) Save(state *SyncState) (err error) {
+	var data []byte
+	if data, err = json.Marshal(state); err != nil {
+		return
+	}
+	ms.lock.Lock()
+	ms.data = data
+	ms.lock.Unlock()
+	return
+}
+
+type fileStateStore struct {
+	filePath string
+}
+
+// NewFileStateStore creates IStateStore that keeps the sync state in a local JSON file
+// filePath: state file path. The file is created on the first save
+func NewFileStateStore(filePath string) IStateStore {
+	return &fileStateStore{
+		filePath: filePath,
+	}
+}
+
+func (fs *fileStateStore) Load() (state *SyncState, err error) {
+	state = new(SyncState)
+	var data []byte
+	if data, err = os.ReadFile(fs.filePath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		err = fmt.Errorf("state file \"%s\": %s", fs.filePath, err.Error())
+	}
+	return
+}
+
+func (fs *fileStateStore) Save(state *SyncState) (err error) {
+	var data []byte
+	if data, err = json.MarshalIndent(state, "", "  "); err != nil {
+		return
+	}
+	var tmpFile *os.File
+	if tmpFile, err = os.CreateTemp(filepath.Dir(fs.filePath), filepath.Base(fs.filePath)+".*"); err != nil {
+		return
+	}
+	if _, err = tmpFile.Write(data); err == nil {
+		err = tmpFile.Close()
+	} else {
+		_ = tmpFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), fs.filePath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return
+}
+
+// hashUser hashes Google user attributes and the teams the user is a member of
+func (s *sync) hashUser(user *User) string {
+	var groups = s.userTeams(user)
+	sort.Strings(groups)
+	var values = []any{user.Email, user.FullName, user.FirstName, user.LastName, user.Active, groups, user.Manager, user.Attributes}
+	if user.Protected {
+		values = append(values, user.Protected)
+	}
+	var data, _ = json.Marshal(values)
+	var hash = sha256.Sum256(data)
+	return base64.RawStdEncoding.EncodeToString(hash[:16])
+}
+
+// sourceFingerprint hashes all users and groups loaded from the data source
+func (s *sync) sourceFingerprint() string {
+	var entries []string
+	s.source.Users(func(user *User) {
+		entries = append(entries, fmt.Sprintf("u:%s:%s", user.Id, s.hashUser(user)))
+	})
+	for _, team := range s.teams {
+		entries = append(entries, fmt.Sprintf("g:%s:%s", team.Id, team.Name))
+	}
+	sort.Strings(entries)
+	var data, _ = json.Marshal(entries)
+	var hash = sha256.Sum256(data)
+	return base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// resumableCheckpoint returns the checkpoint of the previous run if it can be continued
+// The checkpoint is discarded if the source data has changed since it was created
+func (s *sync) resumableCheckpoint() (checkpoint *SyncCheckpoint) {
+	if !s.resume || s.state == nil || s.state.Checkpoint == nil {
+		return
+	}
+	var cp = s.state.Checkpoint
+	s.state.Checkpoint = nil
+	switch {
+	case cp.Plan == nil || cp.Plan.Version != planVersion || cp.Plan.ScimUrl != s.baseUrl:
+		s.debugLogger("Checkpoint is not valid. Starting a fresh plan")
+	case time.Since(cp.Created) > checkpointMaxAge:
+		s.debugLogger("Checkpoint has expired. Starting a fresh plan")
+	case cp.SourceHash != s.sourceFingerprint():
+		s.debugLogger("Source data has changed since the checkpoint. Starting a fresh plan")
+	default:
+		checkpoint = cp
+	}
+	return
+}
+
+func failureKey(resourceType ResourceType, id string) string {
+	return fmt.Sprintf("%s/%s", resourceType, id)
+}
+
+func (s *sync) loadState() (err error) {
+	s.state = nil
+	if s.stateStore == nil {
+		return
+	}
+	var state *SyncState
+	if state, err = s.stateStore.Load(); err != nil {
+		return
+	}
+	if state == nil {
+		state = new(SyncState)
+	}
+	if state.MissingSince == nil {
+		state.MissingSince = make(map[string]time.Time)
+	}
+	if state.DeactivatedAt == nil {
+		state.DeactivatedAt = make(map[string]time.Time)
+	}
+	if state.UserLinks == nil {
+		state.UserLinks = make(map[string]string)
+	}
+	if state.GroupLinks == nil {
+		state.GroupLinks = make(map[string]string)
+	}
+	if state.UserHashes == nil {
+		state.UserHashes = make(map[string]string)
+	}
+	if state.Failures == nil {
+		state.Failures = make(map[string]*FailureHistory)
+	}
+	s.state = state
+	return
+}
+
+// saveState persists the sync state. stat, if provided, receives warnings about the data that did not fit the state store
+// The resume checkpoint, user hashes and links are dropped in this order until the state fits
+func (s *sync) saveState(stat *SyncStat) (err error) {
+	if s.stateStore == nil || s.state == nil {
+		return
+	}
+	if limit, ok := s.stateStore.(IStateSizeLimit); ok {
+		var maxSize = limit.MaxStateSize()
+		var size = func() int {
+			var data, _ = json.Marshal(s.state)
+			return len(data)
+		}
+		var warn = func(message string) {
+			s.debugLogger(message)
+			if stat != nil {
+				stat.Warnings = append(stat.Warnings, message)
+			}
+		}
+		if s.state.Checkpoint != nil && size() > maxSize {
+			s.state.Checkpoint = nil
+			warn("Resume checkpoint does not fit the state store and was not saved. The next run plans the sync again")
+		}
+		if len(s.state.UserHashes) > 0 && size() > maxSize {
+			s.state.UserHashes = nil
+			warn("User hashes do not fit the state store and were not saved. The next run compares all users")
+		}
+		if (len(s.state.UserLinks) > 0 || len(s.state.GroupLinks) > 0) && size() > maxSize {
+			s.state.UserLinks = nil
+			s.state.GroupLinks = nil
+			warn("User and team links do not fit the state store and were not saved")
+		}
+		if current := size(); current > maxSize {
+			err = fmt.Errorf("sync state of %d bytes exceeds the state store limit of %d bytes", current, maxSize)
+			return
+		}
+	}
+	err = s.stateStore.Save(s.state)
+	return
+}
+
+// recordResults updates links and failure history from the executed operations
+func (s *sync) recordResults(stat *SyncStat) {
+	if s.state == nil {
+		return
+	}
+	var now = time.Now().UTC()
+	// forget deactivation of users that are active again or no longer exist
+	if s.scimUsers != nil {
+		for userId := range s.state.DeactivatedAt {
+			if user, ok := s.scimUsers[userId]; !ok || user.Active {
+				delete(s.state.DeactivatedAt, userId)
+			}
+		}
+	}
+	for _, r := range stat.Records {
+		if r.ResourceType == UsersResource && r.Success() {
+			switch r.Kind {
+			case DeactivateOperation:
+				if _, ok := s.state.DeactivatedAt[r.KeeperId]; !ok {
+					s.state.DeactivatedAt[r.KeeperId] = now
+				}
+				delete(s.state.MissingSince, r.KeeperId)
+			case DeleteOperation:
+				delete(s.state.DeactivatedAt, r.KeeperId)
+				delete(s.state.MissingSince, r.KeeperId)
+			}
+		}
+		var id = r.GoogleId
+		if len(id) == 0 {
+			id = r.KeeperId
+		}
+		if len(id) == 0 || r.Skipped() {
+			continue
+		}
+		var key = failureKey(r.ResourceType, id)
+		if r.Failed() {
+			var fh, ok = s.state.Failures[key]
+			if !ok {
+				fh = &FailureHistory{FirstSeen: now}
+				s.state.Failures[key] = fh
+			}
+			fh.Count++
+			fh.LastSeen = now
+			fh.LastError = r.Error
+			continue
+		}
+		delete(s.state.Failures, key)
+
+		if len(r.GoogleId) == 0 || isPendingKeeperId(r.KeeperId) {
+			continue
+		}
+		var links = s.state.UserLinks
+		if r.ResourceType == GroupsResource {
+			links = s.state.GroupLinks
+		}
+		if r.Kind == DeleteOperation {
+			delete(links, r.GoogleId)
+		} else {
+			links[r.GoogleId] = r.KeeperId
+		}
+	}
+	s.state.LastSync = now
+}
+
+// isUserUnchanged checks if the source user is linked and has not changed since the last successful sync
+func (s *sync) isUserUnchanged(user *User, keeperUser *scimUser) bool {
+	if !s.skipUnchanged || s.state == nil || keeperUser.ExternalId != user.Id {
+		return false
+	}
+	var hash, ok = s.state.UserHashes[user.Id]
+	return ok && hash == s.hashUser(user)
+}
+
+// recordUserHashes stores attribute hashes of the source users that were synced without failures or skips
+// checkpoint, if provided, holds users that were not synced by the previous runs of the plan
+func (s *sync) recordUserHashes(stat *SyncStat, checkpoint *SyncCheckpoint) {
+	if s.state == nil {
+		return
+	}
+	var incomplete = NewSet[string]()
+	for _, r := range stat.Records {
+		if r.ResourceType == UsersResource && !r.Success() {
+			incomplete.Add(r.GoogleId)
+		}
+	}
+	if checkpoint != nil {
+		incomplete.Union(checkpoint.Incomplete)
+	}
+	var hashes = make(map[string]string)
+	s.source.Users(func(user *User) {
+		if incomplete.Has(user.Id) {
+			if hash, ok := s.state.UserHashes[user.Id]; ok {
+				hashes[user.Id] = hash
+			}
+		} else {
+			hashes[user.Id] = s.hashUser(user)
+		}
+	})
+	s.state.UserHashes = hashes
+}
@@ -0,0 +1,172 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateStores(t *testing.T) {
+	var tests = []struct {
+		name  string
+		store IStateStore
+	}{
+		{name: "memory", store: NewMemoryStateStore()},
+		{name: "file", store: NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))},
+	}
+	var now = time.Now().UTC().Truncate(time.Second)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state, err = tt.store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(state, new(SyncState)) {
+				t.Errorf("initial state: %+v", state)
+			}
+			state = &SyncState{
+				MissingSince: map[string]time.Time{"k1": now},
+				UserLinks:    map[string]string{"u1": "k1"},
+				GroupLinks:   map[string]string{"g1": "t1"},
+				UserHashes:   map[string]string{"u1": "hash"},
+				Failures:     map[string]*FailureHistory{"Users/u2": {Count: 2, FirstSeen: now, LastSeen: now, LastError: "error"}},
+				LastSync:     now,
+			}
+			if err = tt.store.Save(state); err != nil {
+				t.Fatal(err)
+			}
+			var loaded *SyncState
+			if loaded, err = tt.store.Load(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded, state) {
+				t.Errorf("loaded: %+v, expected: %+v", loaded, state)
+			}
+		})
+	}
+}
+
+func TestFileStateStoreInvalidFile(t *testing.T) {
+	var filePath = filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(filePath, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStateStore(filePath).Load(); err == nil {
+		t.Error("invalid state file is loaded")
+	}
+}
+
+func TestRecordResults(t *testing.T) {
+	var s = &sync{
+		stateStore: NewMemoryStateStore(),
+		scimUsers:  map[string]*scimUser{"k1": {User: User{Id: "k1", Active: true}}},
+	}
+	if err := s.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	s.state.UserLinks["u3"] = "k3"
+	s.state.Failures[failureKey(UsersResource, "u1")] = &FailureHistory{Count: 1}
+	var stat = new(SyncStat)
+	for _, record := range []*SyncRecord{
+		{Kind: UpdateOperation, ResourceType: UsersResource, KeeperId: "k1", GoogleId: "u1"},
+		{Kind: CreateOperation, ResourceType: GroupsResource, KeeperId: "t1", GoogleId: "g1"},
+		{Kind: UpdateOperation, ResourceType: UsersResource, KeeperId: "k2", GoogleId: "u2", Error: "conflict"},
+		{Kind: DeleteOperation, ResourceType: UsersResource, KeeperId: "k3", GoogleId: "u3"},
+		{Kind: CreateOperation, ResourceType: UsersResource, KeeperId: "k4", GoogleId: "u4", SkipReason: "excluded"},
+	} {
+		stat.addRecord(record)
+	}
+	s.recordResults(stat)
+	if expected := map[string]string{"u1": "k1"}; !reflect.DeepEqual(s.state.UserLinks, expected) {
+		t.Errorf("user links: %v, expected: %v", s.state.UserLinks, expected)
+	}
+	if expected := map[string]string{"g1": "t1"}; !reflect.DeepEqual(s.state.GroupLinks, expected) {
+		t.Errorf("group links: %v, expected: %v", s.state.GroupLinks, expected)
+	}
+	if len(s.state.Failures) != 1 || s.state.Failures[failureKey(UsersResource, "u2")] == nil {
+		t.Errorf("failures: %v", s.state.Failures)
+	}
+	if s.state.LastSync.IsZero() {
+		t.Error("last sync time is not recorded")
+	}
+}
+
+// limitedStateStore is a memory state store with a size limit
+type limitedStateStore struct {
+	memoryStateStore
+	maxSize int
+}
+
+func (ls *limitedStateStore) MaxStateSize() int {
+	return ls.maxSize
+}
+
+func TestSaveStateSizeLimit(t *testing.T) {
+	var newState = func() *SyncState {
+		var state = &SyncState{
+			UserLinks:  make(map[string]string),
+			UserHashes: make(map[string]string),
+			Checkpoint: &SyncCheckpoint{Plan: &SyncPlan{Operations: make([]*PlannedOperation, 20)}},
+		}
+		for i := 0; i < 20; i++ {
+			state.UserLinks[fmt.Sprintf("u%02d", i)] = fmt.Sprintf("k%02d", i)
+			state.UserHashes[fmt.Sprintf("u%02d", i)] = "0123456789abcdef0123456789abcdef"
+		}
+		return state
+	}
+	var size = func(state *SyncState) int {
+		var data, _ = json.Marshal(state)
+		return len(data)
+	}
+	var full = newState()
+	var withoutCheckpoint = newState()
+	withoutCheckpoint.Checkpoint = nil
+	var withoutHashes = newState()
+	withoutHashes.Checkpoint = nil
+	withoutHashes.UserHashes = nil
+
+	var tests = []struct {
+		name       string
+		maxSize    int
+		checkpoint bool
+		hashes     bool
+		links      bool
+		warnings   int
+		failed     bool
+	}{
+		{name: "state fits", maxSize: size(full), checkpoint: true, hashes: true, links: true},
+		{name: "checkpoint is dropped", maxSize: size(withoutCheckpoint), hashes: true, links: true, warnings: 1},
+		{name: "hashes are dropped", maxSize: size(withoutHashes), links: true, warnings: 2},
+		{name: "links are dropped", maxSize: size(withoutHashes) - 1, warnings: 3},
+		{name: "state does not fit", maxSize: 1, warnings: 3, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var store = &limitedStateStore{maxSize: tt.maxSize}
+			var s = &sync{stateStore: store, state: newState()}
+			var stat = new(SyncStat)
+			var err = s.saveState(stat)
+			if failed := err != nil; failed != tt.failed {
+				t.Fatalf("error: %v", err)
+			}
+			if len(stat.Warnings) != tt.warnings {
+				t.Errorf("warnings: %v", stat.Warnings)
+			}
+			if tt.failed {
+				return
+			}
+			var state, _ = store.Load()
+			if (state.Checkpoint != nil) != tt.checkpoint || (len(state.UserHashes) > 0) != tt.hashes ||
+				(len(state.UserLinks) > 0) != tt.links {
+				t.Errorf("checkpoint: %t, hashes: %d, links: %d", state.Checkpoint != nil, len(state.UserHashes), len(state.UserLinks))
+			}
+			if len(store.data) > tt.maxSize {
+				t.Errorf("%d bytes saved", len(store.data))
+			}
+		})
+	}
+}
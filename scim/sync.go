@@ -1,10 +1,15 @@
 package scim
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/text/cases"
 	"log"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
 )
 
 // NewScimSync creates IScimSync interface for syncing with external CRMs
@@ -13,22 +18,59 @@ import (
 // token: SCIM token
 func NewScimSync(source ICrmDataSource, url string, token string) IScimSync {
 	var s = &sync{
-		source:  source,
-		baseUrl: url,
-		token:   token,
+		source:      source,
+		baseUrl:     url,
+		token:       token,
+		deprovision: DeleteDeprovision,
 	}
 	source.SetDebugLogger(s.debugLogger)
 	return s
 }
 
+const defaultFullSyncInterval = 24 * time.Hour
+
 type sync struct {
-	source      ICrmDataSource
-	scimUsers   map[string]*scimUser
-	scimGroups  map[string]*scimGroup
-	baseUrl     string
-	token       string
-	verbose     bool
-	destructive int32
+	source               ICrmDataSource
+	scimUsers            map[string]*scimUser
+	scimGroups           map[string]*scimGroup
+	baseUrl              string
+	token                string
+	verbose              bool
+	destructive          int32
+	parallelism          int32
+	emailRewrite         []*EmailRewriteRule
+	teamMapping          map[string]string
+	teamNameTemplate     *template.Template
+	resume               bool
+	renameAliasMatches   bool
+	exclusions           []*Exclusion
+	protectedMarker      *ProtectedMarker
+	incremental          bool
+	fullSyncInterval     time.Duration
+	skipUnchanged        bool
+	gracePeriod          time.Duration
+	stateStore           IStateStore
+	state                *SyncState
+	deprovision          DeprovisionPolicy
+	deleteAfter          time.Duration
+	deletionLimit        int32
+	deletionLimitPercent int32
+	// teams holds Keeper teams built from Google groups. Keyed by team external ID
+	teams map[string]*Group
+	// groupTeams maps Google group ID to the team external ID
+	groupTeams map[string]string
+	// teamSources holds Google group IDs of the teams fed by the team mapping
+	teamSources map[string][]string
+	// ambiguousTeams holds Keeper teams that could not be matched to Google groups unambiguously
+	ambiguousTeams Set[string]
+	// excludedGroups holds Google groups covered by "SCIM Exclude". Keyed by Google group ID
+	excludedGroups map[string]*excludedResource
+	// excludedTeams maps IDs of Keeper teams covered by "SCIM Exclude" to the exclusion entry
+	excludedTeams map[string]string
+	// excludedUsers maps IDs of Google users covered by "SCIM Exclude" to the exclusion entry
+	excludedUsers map[string]string
+	// protectedUsers holds IDs and lookup emails of protected Google users
+	protectedUsers Set[string]
 }
 
 func (s *sync) debugLogger(message string) {
@@ -39,40 +81,175 @@ func (s *sync) debugLogger(message string) {
 func (s *sync) Source() ICrmDataSource {
 	return s.source
 }
-func (s *sync) Verbose() bool              { return s.verbose }
-func (s *sync) SetVerbose(value bool)      { s.verbose = value }
-func (s *sync) Destructive() int32         { return s.destructive }
-func (s *sync) SetDestructive(value int32) { s.destructive = value }
+func (s *sync) Verbose() bool                  { return s.verbose }
+func (s *sync) SetVerbose(value bool)          { s.verbose = value }
+func (s *sync) Destructive() int32             { return s.destructive }
+func (s *sync) SetDestructive(value int32)     { s.destructive = value }
+func (s *sync) Parallelism() int32             { return s.parallelism }
+func (s *sync) SetParallelism(value int32)     { s.parallelism = value }
+func (s *sync) TeamMapping() map[string]string { return s.teamMapping }
+func (s *sync) SetTeamMapping(mapping map[string]string) {
+	s.teamMapping = make(map[string]string)
+	var fold = cases.Fold()
+	for group, team := range mapping {
+		s.teamMapping[fold.String(group)] = team
+	}
+}
+func (s *sync) TeamNameTemplate() *template.Template        { return s.teamNameTemplate }
+func (s *sync) SetTeamNameTemplate(tmpl *template.Template) { s.teamNameTemplate = tmpl }
+func (s *sync) EmailRewrite() []*EmailRewriteRule           { return s.emailRewrite }
+func (s *sync) SetEmailRewrite(rules []*EmailRewriteRule)   { s.emailRewrite = rules }
+func (s *sync) Resume() bool                                { return s.resume }
+func (s *sync) SetResume(value bool)                        { s.resume = value }
+func (s *sync) RenameAliasMatches() bool                    { return s.renameAliasMatches }
+func (s *sync) SetRenameAliasMatches(value bool)            { s.renameAliasMatches = value }
+func (s *sync) Exclusions() []*Exclusion                    { return s.exclusions }
+func (s *sync) SetExclusions(exclusions []*Exclusion)       { s.exclusions = exclusions }
+func (s *sync) ProtectedMarker() *ProtectedMarker           { return s.protectedMarker }
+func (s *sync) SetProtectedMarker(marker *ProtectedMarker)  { s.protectedMarker = marker }
+func (s *sync) Incremental() (bool, time.Duration) {
+	return s.incremental, s.fullSyncInterval
+}
+func (s *sync) SetIncremental(value bool, fullSyncInterval time.Duration) {
+	s.incremental = value
+	s.fullSyncInterval = fullSyncInterval
+}
+func (s *sync) GracePeriod() time.Duration         { return s.gracePeriod }
+func (s *sync) SetGracePeriod(value time.Duration) { s.gracePeriod = value }
+func (s *sync) StateStore() IStateStore            { return s.stateStore }
+func (s *sync) SetStateStore(value IStateStore)    { s.stateStore = value }
+func (s *sync) Deprovision() DeprovisionPolicy     { return s.deprovision }
+func (s *sync) SetDeprovision(value DeprovisionPolicy) {
+	if len(value) == 0 {
+		value = DeleteDeprovision
+	}
+	s.deprovision = value
+}
+func (s *sync) DeleteDeactivatedAfter() time.Duration         { return s.deleteAfter }
+func (s *sync) SetDeleteDeactivatedAfter(value time.Duration) { s.deleteAfter = value }
+func (s *sync) DeletionLimit() (int32, int32) {
+	return s.deletionLimit, s.deletionLimitPercent
+}
+func (s *sync) SetDeletionLimit(count int32, percent int32) {
+	s.deletionLimit = count
+	s.deletionLimitPercent = percent
+}
+
+func (s *sync) Sync(ctx context.Context) (stat *SyncStat, err error) {
+	if err = s.populateSource(ctx); err != nil {
+		return
+	}
+	if err = s.loadState(); err != nil {
+		return
+	}
+	var plan *SyncPlan
+	var checkpoint = s.resumableCheckpoint()
+	if checkpoint != nil {
+		s.debugLogger(fmt.Sprintf("Resume sync from the checkpoint created at %s", checkpoint.Created.Format(time.RFC3339)))
+		// Keeper users are needed to record the results
+		if err = s.populateScim(ctx); err != nil {
+			return
+		}
+		plan = s.blockProtected(checkpoint.Plan)
+	} else {
+		if plan, err = s.plan(ctx); err != nil {
+			return
+		}
+		checkpoint = &SyncCheckpoint{
+			SourceHash: s.sourceFingerprint(),
+			Created:    time.Now().UTC(),
+			Plan:       plan,
+		}
+	}
+	if err = s.checkDeletionLimit(plan); err != nil {
+		return
+	}
+	s.debugLogger("Execute SCIM operations")
+	stat = s.executePlan(ctx, plan, checkpoint)
+	s.recordResults(stat)
+	if !stat.Incomplete {
+		s.recordUserHashes(stat, checkpoint)
+		if s.state != nil && !plan.Incremental {
+			s.state.LastFullSync = s.state.LastSync
+		}
+	}
+	if s.state != nil {
+		s.state.Checkpoint = nil
+		if s.resume && stat.Incomplete {
+			s.state.Checkpoint = checkpoint
+		}
+	}
+	err = s.saveState(stat)
+	return
+}
+
+// Plan computes SCIM operations without executing them. The sync state is not saved
+func (s *sync) Plan(ctx context.Context) (plan *SyncPlan, err error) {
+	if err = s.populateSource(ctx); err != nil {
+		return
+	}
+	if err = s.loadState(); err != nil {
+		return
+	}
+	plan, err = s.plan(ctx)
+	return
+}
 
-func (s *sync) Sync() (stat *SyncStat, err error) {
-	if err = s.Source().Populate(); err != nil {
+func (s *sync) populateSource(ctx context.Context) (err error) {
+	if err = s.Source().Populate(ctx); err != nil {
 		return
 	}
 	if s.Source().LoadErrors() {
 		s.debugLogger("Switching to the Safe Mode due to errors")
 		s.destructive = -1
 	}
-	if err = s.populateScim(); err != nil {
+	s.buildTeams()
+	s.buildProtection()
+	return
+}
+
+// plan loads Keeper users and teams and computes SCIM operations. Source and state have to be loaded
+func (s *sync) plan(ctx context.Context) (plan *SyncPlan, err error) {
+	if err = s.populateScim(ctx); err != nil {
 		return
 	}
-	var syncStat = new(SyncStat)
-	s.debugLogger("Synchronize groups")
-	if syncStat.SuccessGroups, syncStat.FailedGroups, err = s.syncGroups(); err != nil {
+	s.skipUnchanged = false
+	if s.incremental && s.state != nil && !s.state.LastFullSync.IsZero() {
+		var interval = s.fullSyncInterval
+		if interval <= 0 {
+			interval = defaultFullSyncInterval
+		}
+		if time.Since(s.state.LastFullSync) < interval {
+			s.skipUnchanged = true
+		} else {
+			s.debugLogger("Full reconciliation is due")
+		}
+	}
+	var syncPlan = &SyncPlan{
+		Version:     planVersion,
+		ScimUrl:     s.baseUrl,
+		Created:     time.Now().UTC(),
+		Incremental: s.skipUnchanged,
+		Warnings:    s.source.Warnings(),
+	}
+	syncPlan.Users, syncPlan.Groups = s.snapshotScim()
+	s.debugLogger("Plan groups")
+	if err = s.planGroups(syncPlan); err != nil {
 		return
 	}
-	s.debugLogger("Synchronize users")
-	if syncStat.SuccessUsers, syncStat.FailedUsers, err = s.syncUsers(); err != nil {
+	s.debugLogger("Plan users")
+	if err = s.planUsers(syncPlan); err != nil {
 		return
 	}
-	s.debugLogger("Synchronize membership")
-	if syncStat.SuccessMembership, syncStat.FailedMembership, err = s.syncMembership(); err != nil {
+	s.debugLogger("Plan membership")
+	if err = s.planMembership(syncPlan); err != nil {
 		return
 	}
-	stat = syncStat
+	plan = syncPlan
 	return
 }
 
-func (s *sync) syncGroups() (successes []string, failures []string, err error) {
+func (s *sync) planGroups(plan *SyncPlan) (err error) {
 	if s.scimGroups == nil {
 		err = errors.New("SCIM groups were not populated")
 		return
@@ -83,131 +260,280 @@ func (s *sync) syncGroups() (successes []string, failures []string, err error) {
 	}
 
 	var externalGroups = make(map[string]*Group)
-	s.source.Groups(func(group *Group) {
-		externalGroups[group.Id] = group
-	})
-
-	var er1 error
-	var fold = cases.Fold()
+	for k, v := range s.teams {
+		externalGroups[k] = v
+	}
 
-	for matchRound := 0; matchRound < 3; matchRound++ {
-		if len(keeperGroups) == 0 || len(externalGroups) == 0 {
-			break
+	var matches, conflicts = s.matchGroups(externalGroups, keeperGroups)
+	s.ambiguousTeams = NewSet[string]()
+	for _, conflict := range conflicts {
+		plan.Operations = append(plan.Operations, &PlannedOperation{
+			Kind:         UpdateOperation,
+			ResourceType: GroupsResource,
+			Name:         conflict.group.Name,
+			GoogleId:     conflict.group.Id,
+			Method:       "PATCH",
+			SkipReason:   "ambiguous match: " + conflict.reason,
+		})
+		delete(externalGroups, conflict.group.Id)
+		for _, team := range conflict.teams {
+			delete(keeperGroups, team.Id)
+			s.ambiguousTeams.Add(team.Id)
 		}
-
-		var groupLookup = make(map[string]*scimGroup)
-		switch matchRound {
-		case 0:
-			for _, v := range keeperGroups {
-				groupLookup[v.ExternalId] = v
-			}
-		case 1:
-			for _, v := range keeperGroups {
-				groupLookup[fold.String(v.Name)] = v
-			}
-		case 2:
-			var extKeys []string
-			for k := range externalGroups {
-				extKeys = append(extKeys, k)
-			}
-			var scimKeys []string
-			for k, v := range keeperGroups {
-				if len(v.ExternalId) > 0 {
-					scimKeys = append(scimKeys, k)
-				}
-			}
-			var minKeys = len(extKeys)
-			if minKeys > len(scimKeys) {
-				minKeys = len(scimKeys)
-			}
-			for i := 0; i < minKeys; i++ {
-				groupLookup[extKeys[i]] = keeperGroups[scimKeys[i]]
+	}
+	// excluded teams are never updated or deleted
+	s.excludedTeams = make(map[string]string)
+	var excludedSources = NewSet[string]()
+	for _, teamId := range sortedKeys(keeperGroups) {
+		var team = keeperGroups[teamId]
+		var entry = s.exclusionOf(team.Name)
+		if len(entry) == 0 {
+			if excluded, ok := s.excludedGroups[team.ExternalId]; ok {
+				entry = excluded.entry
 			}
 		}
+		if len(entry) == 0 {
+			continue
+		}
+		plan.Operations = append(plan.Operations, &PlannedOperation{
+			Kind:         UpdateOperation,
+			ResourceType: GroupsResource,
+			Name:         team.Name,
+			KeeperId:     team.Id,
+			GoogleId:     team.ExternalId,
+			Method:       "PATCH",
+			SkipReason:   exclusionReason(entry),
+		})
+		s.excludedTeams[team.Id] = entry
+		excludedSources.Add(team.ExternalId)
+		delete(keeperGroups, team.Id)
+	}
+	for groupId, keeperGroup := range matches {
+		if _, ok := s.excludedTeams[keeperGroup.Id]; ok {
+			delete(matches, groupId)
+			delete(externalGroups, groupId)
+		}
+	}
+	for _, groupId := range sortedKeys(s.excludedGroups) {
+		if !excludedSources.Has(groupId) {
+			plan.Operations = append(plan.Operations, &PlannedOperation{
+				Kind:         CreateOperation,
+				ResourceType: GroupsResource,
+				Name:         s.excludedGroups[groupId].name,
+				GoogleId:     groupId,
+				Method:       "POST",
+				SkipReason:   exclusionReason(s.excludedGroups[groupId].entry),
+			})
+		}
+	}
+	for _, groupId := range sortedKeys(matches) {
+		var group = externalGroups[groupId]
+		var keeperGroup = matches[groupId]
+		var value = make(map[string]any)
+		if keeperGroup.ExternalId != group.Id {
+			value["externalId"] = group.Id
+		}
+		if keeperGroup.Name != group.Name {
+			value["displayName"] = group.Name
+		}
 
-		for _, group := range externalGroups {
-			var key string
-			switch matchRound {
-			case 0, 2:
-				key = group.Id
-			case 1:
-				key = fold.String(group.Name)
-			default:
-				continue
-			}
-
-			if keeperGroup, ok := groupLookup[key]; ok {
-				var value = make(map[string]any)
-				if keeperGroup.ExternalId != group.Id {
-					value["externalId"] = group.Id
-				}
-				if keeperGroup.Name != group.Name {
-					value["displayName"] = group.Name
-				}
-
-				if len(value) > 0 {
-					var op = make(map[string]any)
-					op["op"] = "replace"
-					op["value"] = value
-					var payload = make(map[string]any)
-					payload["schemas"] = []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}
-					payload["Operations"] = []any{op}
-					if er1 = s.patchResource("Groups", keeperGroup.Id, payload); er1 == nil {
-						keeperGroup.ExternalId = group.Id
-						keeperGroup.Name = group.Name
-						successes = append(successes, fmt.Sprintf("SCIM updated group \"%s\"", group.Name))
-					} else {
-						failures = append(failures, fmt.Sprintf("PATCH group \"%s\" error: %s", group.Name, er1.Error()))
-					}
-				}
-				delete(keeperGroups, keeperGroup.Id)
-				delete(externalGroups, group.Id)
-			}
+		if len(value) > 0 {
+			var op = make(map[string]any)
+			op["op"] = "replace"
+			op["value"] = value
+			var payload = make(map[string]any)
+			payload["schemas"] = []any{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}
+			payload["Operations"] = []any{op}
+			plan.Operations = append(plan.Operations, &PlannedOperation{
+				Kind:         UpdateOperation,
+				ResourceType: GroupsResource,
+				Name:         group.Name,
+				KeeperId:     keeperGroup.Id,
+				GoogleId:     group.Id,
+				Method:       "PATCH",
+				Attributes:   sortedKeys(value),
+				Payload:      payload,
+			})
+			keeperGroup.ExternalId = group.Id
+			keeperGroup.Name = group.Name
+		}
+		if s.state != nil {
+			s.state.GroupLinks[group.Id] = keeperGroup.Id
 		}
+		delete(keeperGroups, keeperGroup.Id)
+		delete(externalGroups, group.Id)
 	}
 	if len(externalGroups) > 0 {
-		for _, group := range externalGroups {
+		for _, groupId := range sortedKeys(externalGroups) {
+			var group = externalGroups[groupId]
 			var payload = make(map[string]any)
-			payload["schemas"] = []string{"urn:ietf:params:scim:schemas:core:2.0:Group"}
+			payload["schemas"] = []any{"urn:ietf:params:scim:schemas:core:2.0:Group"}
 			payload["displayName"] = group.Name
 			payload["externalId"] = group.Id
 
-			var added map[string]any
-			if added, er1 = s.postResource("Groups", payload); er1 == nil {
-				if sg := parseScimGroup(added); sg != nil {
-					s.scimGroups[sg.Id] = sg
-				}
-				successes = append(successes, fmt.Sprintf("SCIM added group \"%s\"", group.Name))
-			} else {
-				failures = append(failures, fmt.Sprintf("POST group \"%s\" error: %s", group.Name, er1.Error()))
-			}
+			var keeperId = PendingKeeperId(GroupsResource, group.Id)
+			plan.Operations = append(plan.Operations, &PlannedOperation{
+				Kind:         CreateOperation,
+				ResourceType: GroupsResource,
+				Name:         group.Name,
+				KeeperId:     keeperId,
+				GoogleId:     group.Id,
+				Method:       "POST",
+				Payload:      payload,
+			})
+			var sg = new(scimGroup)
+			sg.Id = keeperId
+			sg.Name = group.Name
+			sg.ExternalId = group.Id
+			s.scimGroups[sg.Id] = sg
 		}
 	}
 
 	if len(keeperGroups) > 0 {
-		for groupId, group := range keeperGroups {
+		for _, groupId := range sortedKeys(keeperGroups) {
+			var group = keeperGroups[groupId]
+			var op = &PlannedOperation{
+				Kind:         DeleteOperation,
+				ResourceType: GroupsResource,
+				Name:         group.Name,
+				KeeperId:     groupId,
+				GoogleId:     group.ExternalId,
+				Method:       "DELETE",
+			}
 			if s.destructive >= 0 {
-				if s.destructive > 0 || len(group.ExternalId) > 0 {
-					if er1 = s.deleteResource("Groups", groupId); er1 == nil {
-						delete(s.scimGroups, groupId)
-						successes = append(successes, fmt.Sprintf("SCIM deleted group \"%s\"", group.Name))
-					} else {
-						failures = append(failures, fmt.Sprintf("DELETE group \"%s\" error: %s", group.Name, er1))
-					}
+				if len(group.ExternalId) > 0 || (s.destructive > 0 && s.isManagedTeamName(group.Name)) {
+					delete(s.scimGroups, groupId)
 				} else {
-					if s.verbose {
-						failures = append(failures, fmt.Sprintf("DELETE group \"%s\": delete skipped since the group is not controlled by SCIM", group.Name))
+					if !s.verbose {
+						continue
+					}
+					if s.destructive > 0 {
+						op.SkipReason = "delete skipped since the group is outside of the \"Team Name Template\" namespace"
+					} else {
+						op.SkipReason = "delete skipped since the group is not controlled by SCIM"
 					}
 				}
 			} else {
-				failures = append(failures, fmt.Sprintf("DELETE group \"%s\": delete skipped since the \"Safe Mode\" is enforced", group.Name))
+				op.SkipReason = "delete skipped since the \"Safe Mode\" is enforced"
 			}
+			plan.Operations = append(plan.Operations, op)
+		}
+	}
+	return
+}
+
+// groupConflict is a Google group that cannot be matched to a Keeper team unambiguously
+type groupConflict struct {
+	group  *Group
+	teams  []*scimGroup
+	reason string
+}
+
+func describeTeams(teams []*scimGroup) string {
+	var names []string
+	for _, team := range teams {
+		names = append(names, fmt.Sprintf("\"%s\" (%s)", team.Name, team.Id))
+	}
+	return strings.Join(names, ", ")
+}
+
+// matchGroups finds Keeper teams for Google groups. The result is keyed by Google group ID
+// Teams are matched by external ID first, then by the case-insensitive name.
+// A match is reported as a conflict if several teams share the external ID or the name,
+// several Google groups share the name, or the team with the same name is linked to another Google group
+func (s *sync) matchGroups(externalGroups map[string]*Group, keeperGroups map[string]*scimGroup) (
+	matches map[string]*scimGroup, conflicts []*groupConflict) {
+	matches = make(map[string]*scimGroup)
+	var fold = cases.Fold()
+	var claimed = NewSet[string]()
+	var byId = func(teams []*scimGroup) {
+		sort.Slice(teams, func(i, j int) bool { return teams[i].Id < teams[j].Id })
+	}
+
+	var byExternalId = make(map[string][]*scimGroup)
+	for _, v := range keeperGroups {
+		if len(v.ExternalId) > 0 {
+			byExternalId[v.ExternalId] = append(byExternalId[v.ExternalId], v)
+		}
+	}
+	var unmatched []*Group
+	for _, groupId := range sortedKeys(externalGroups) {
+		var group = externalGroups[groupId]
+		var teams = byExternalId[group.Id]
+		if len(teams) == 0 {
+			// a team that was fed by a mapped Google group before
+			for _, sourceId := range s.teamSources[group.Id] {
+				teams = append(teams, byExternalId[sourceId]...)
+			}
+		}
+		switch len(teams) {
+		case 0:
+			unmatched = append(unmatched, group)
+		case 1:
+			matches[group.Id] = teams[0]
+			claimed.Add(teams[0].Id)
+		default:
+			byId(teams)
+			conflicts = append(conflicts, &groupConflict{
+				group:  group,
+				teams:  teams,
+				reason: fmt.Sprintf("Keeper teams %s are linked to the same Google group or team mapping", describeTeams(teams)),
+			})
+			for _, team := range teams {
+				claimed.Add(team.Id)
+			}
+		}
+	}
+
+	var teamsByName = make(map[string][]*scimGroup)
+	for _, v := range keeperGroups {
+		if !claimed.Has(v.Id) {
+			var name = fold.String(v.Name)
+			teamsByName[name] = append(teamsByName[name], v)
+		}
+	}
+	var groupsByName = make(map[string]int)
+	for _, group := range unmatched {
+		groupsByName[fold.String(group.Name)]++
+	}
+	for _, group := range unmatched {
+		var name = fold.String(group.Name)
+		var teams = teamsByName[name]
+		if _, mapped := s.teamSources[group.Id]; !mapped {
+			// teams outside the team name template namespace are never adopted
+			var managed []*scimGroup
+			for _, team := range teams {
+				if s.isManagedTeamName(team.Name) {
+					managed = append(managed, team)
+				}
+			}
+			teams = managed
+		}
+		if len(teams) == 0 {
+			continue
+		}
+		byId(teams)
+		var conflict = &groupConflict{
+			group: group,
+			teams: teams,
 		}
+		switch {
+		case groupsByName[name] > 1:
+			conflict.reason = fmt.Sprintf("several Google groups are named \"%s\". Keeper teams: %s", group.Name, describeTeams(teams))
+		case len(teams) > 1:
+			conflict.reason = fmt.Sprintf("several Keeper teams have the same name: %s", describeTeams(teams))
+		case len(teams[0].ExternalId) > 0:
+			conflict.reason = fmt.Sprintf("Keeper team %s is linked to another Google group ID \"%s\"", describeTeams(teams), teams[0].ExternalId)
+		default:
+			matches[group.Id] = teams[0]
+			continue
+		}
+		conflicts = append(conflicts, conflict)
 	}
 	return
 }
 
-func (s *sync) syncUsers() (successes []string, failures []string, err error) {
+func (s *sync) planUsers(plan *SyncPlan) (err error) {
 	if s.scimUsers == nil {
 		err = errors.New("SCIM users were not populated")
 		return
@@ -221,23 +547,162 @@ func (s *sync) syncUsers() (successes []string, failures []string, err error) {
 	s.source.Users(func(user *User) {
 		externalUsers[user.Id] = user
 	})
+	var sourceUsers = make(map[string]*User)
+	for k, v := range externalUsers {
+		sourceUsers[k] = v
+	}
+	var cycles = managerCycles(sourceUsers)
+	var linked = make(map[string]*scimUser)
 
-	var er1 error
 	var fold = cases.Fold()
 	var ok bool
 
+	var matches, aliases, conflicts = s.matchUsers(externalUsers)
+	// users with ambiguous match are left untouched
+	for _, conflict := range conflicts {
+		plan.Operations = append(plan.Operations, &PlannedOperation{
+			Kind:         UpdateOperation,
+			ResourceType: UsersResource,
+			Name:         conflict.user.Email,
+			GoogleId:     conflict.user.Id,
+			Method:       "PATCH",
+			SkipReason:   "ambiguous match: " + conflict.reason,
+		})
+		delete(externalUsers, conflict.user.Id)
+		for _, keeperUser := range conflict.users {
+			delete(keeperUsers, keeperUser.Id)
+		}
+	}
+	// excluded users are dropped from the SCIM scope and their Keeper accounts are never modified or deleted
+	s.excludedUsers = make(map[string]string)
+	for _, userId := range sortedUserIds(externalUsers) {
+		var user = externalUsers[userId]
+		var keeperUser = matches[userId]
+		var entry = s.exclusionOf(user.Email, s.keeperEmail(user.Email))
+		if len(entry) == 0 && keeperUser != nil {
+			entry = s.exclusionOf(keeperUser.Email)
+		}
+		if len(entry) == 0 {
+			continue
+		}
+		var op = &PlannedOperation{
+			Kind:         CreateOperation,
+			ResourceType: UsersResource,
+			Name:         user.Email,
+			GoogleId:     user.Id,
+			Method:       "POST",
+			SkipReason:   exclusionReason(entry),
+		}
+		if keeperUser != nil {
+			op.Kind = UpdateOperation
+			op.KeeperId = keeperUser.Id
+			op.Method = "PATCH"
+			delete(keeperUsers, keeperUser.Id)
+		}
+		plan.Operations = append(plan.Operations, op)
+		s.excludedUsers[userId] = entry
+		delete(externalUsers, userId)
+	}
+	// managers are resolved against users in the SCIM scope only. Renamed users are looked up by the new email
+	var userLookup = make(map[string]*scimUser)
+	for _, userId := range sortedKeys(matches) {
+		if user, ok := externalUsers[userId]; ok {
+			userLookup[s.userKey(user.Email)] = matches[userId]
+		}
+	}
+	for _, keeperId := range sortedKeys(keeperUsers) {
+		var keeperUser = keeperUsers[keeperId]
+		if entry := s.exclusionOf(keeperUser.Email); len(entry) > 0 {
+			var kind, method = DeleteOperation, "DELETE"
+			if s.deprovision == DeactivateDeprovision && keeperUser.Active {
+				kind, method = DeactivateOperation, "PATCH"
+			}
+			plan.Operations = append(plan.Operations, &PlannedOperation{
+				Kind:         kind,
+				ResourceType: UsersResource,
+				Name:         keeperUser.Email,
+				KeeperId:     keeperUser.Id,
+				GoogleId:     keeperUser.ExternalId,
+				Method:       method,
+				SkipReason:   exclusionReason(entry),
+			})
+			delete(keeperUsers, keeperId)
+		}
+	}
 	if len(keeperUsers) > 0 && len(externalUsers) > 0 {
-		var userLookup = make(map[string]*scimUser)
+		var keeperByEmail = make(map[string]*scimUser)
 		for _, v := range s.scimUsers {
-			userLookup[fold.String(v.Email)] = v
+			keeperByEmail[fold.String(v.Email)] = v
 		}
+		var unchanged = 0
+		defer func() {
+			if unchanged > 0 {
+				s.debugLogger(fmt.Sprintf("Incremental sync: %d unchanged user(s) skipped", unchanged))
+			}
+		}()
 
-		for _, user := range externalUsers {
+		for _, userId := range sortedUserIds(externalUsers) {
+			var user = externalUsers[userId]
 			var keeperUser *scimUser
-			if keeperUser, ok = userLookup[fold.String(user.Email)]; !ok {
+			if keeperUser, ok = matches[user.Id]; !ok {
+				continue
+			}
+			if s.isUserUnchanged(user, keeperUser) && s.isManagerLinked(user, keeperUser, userLookup) {
+				unchanged++
+				delete(externalUsers, user.Id)
+				delete(keeperUsers, keeperUser.Id)
 				continue
 			}
 			var value = make(map[string]any)
+			var email = s.keeperEmail(user.Email)
+			var notes []string
+			var renamed = fold.String(keeperUser.Email) != fold.String(email)
+			var alias, byAlias = aliases[user.Id]
+			if !byAlias && renamed {
+				// a user linked by alias before keeps the alias username
+				alias = s.userAlias(user, keeperUser.Email)
+				byAlias = len(alias) > 0
+			}
+			if byAlias {
+				if _, ok = aliases[user.Id]; ok {
+					notes = append(notes, fmt.Sprintf("linked by Google alias \"%s\"", alias))
+				}
+				if !s.renameAliasMatches {
+					renamed = false
+				}
+			}
+			if renamed {
+				// the new username is taken by another Keeper user. That user is kept
+				if holder, ok := keeperByEmail[fold.String(email)]; ok && holder.Id != keeperUser.Id {
+					plan.Operations = append(plan.Operations, &PlannedOperation{
+						Kind:         UpdateOperation,
+						ResourceType: UsersResource,
+						Name:         user.Email,
+						KeeperId:     keeperUser.Id,
+						GoogleId:     user.Id,
+						Method:       "PATCH",
+						Attributes:   []string{"userName"},
+						SkipReason: fmt.Sprintf("rename of Keeper user \"%s\" skipped: username \"%s\" belongs to Keeper user Id \"%s\"",
+							keeperUser.Email, holder.Email, holder.Id),
+					})
+					delete(keeperUsers, holder.Id)
+					renamed = false
+				}
+			}
+			if renamed {
+				s.debugLogger(fmt.Sprintf("User \"%s\" was renamed to \"%s\"", keeperUser.Email, email))
+				notes = append(notes, fmt.Sprintf("Keeper username \"%s\" is renamed to \"%s\"", keeperUser.Email, email))
+				value["userName"] = email
+				if _, ok = keeperUser.Resource["emails"]; ok {
+					value["emails"] = []any{map[string]any{"value": email, "type": "work", "primary": true}}
+				}
+			} else {
+				email = keeperUser.Email
+			}
+			var note = strings.Join(notes, "; ")
+			if len(note) > 0 {
+				s.debugLogger(fmt.Sprintf("User \"%s\": %s", user.Email, note))
+			}
 			if keeperUser.ExternalId != user.Id {
 				value["externalId"] = user.Id
 			}
@@ -251,40 +716,78 @@ func (s *sync) syncUsers() (successes []string, failures []string, err error) {
 				value["name.givenName"] = user.FirstName
 			}
 			if keeperUser.Active != user.Active {
-				value["active"] = user.Active
+				if protection := s.protectionOf(keeperUser, user); !user.Active && len(protection) > 0 {
+					plan.Operations = append(plan.Operations, &PlannedOperation{
+						Kind:         DeactivateOperation,
+						ResourceType: UsersResource,
+						Name:         user.Email,
+						KeeperId:     keeperUser.Id,
+						GoogleId:     user.Id,
+						Method:       "PATCH",
+						Attributes:   []string{"active"},
+						SkipReason:   fmt.Sprintf("deactivate blocked: %s", protection),
+					})
+				} else {
+					value["active"] = user.Active
+				}
 			}
-			if len(value) > 0 {
-				var op = make(map[string]any)
-				op["op"] = "replace"
-				op["value"] = value
+			var attributes = s.userAttributes(user, userLookup, cycles)
+			var mappedOps, mappedAttributes = mappedAttributeOperations(attributes, keeperUser)
+			if len(value) > 0 || len(mappedOps) > 0 {
+				var operations []any
+				if len(value) > 0 {
+					var op = make(map[string]any)
+					op["op"] = "replace"
+					op["value"] = value
+					operations = append(operations, op)
+				}
+				operations = append(operations, mappedOps...)
 				var payload = make(map[string]any)
-				payload["schemas"] = []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}
-				payload["Operations"] = []any{op}
-				if er1 = s.patchResource("Users", keeperUser.Id, payload); er1 == nil {
-					keeperUser.ExternalId = user.Id
-					keeperUser.FullName = user.FullName
-					keeperUser.FirstName = user.FirstName
-					keeperUser.LastName = user.LastName
+				payload["schemas"] = []any{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}
+				payload["Operations"] = operations
+				plan.Operations = append(plan.Operations, &PlannedOperation{
+					Kind:         UpdateOperation,
+					ResourceType: UsersResource,
+					Name:         user.Email,
+					KeeperId:     keeperUser.Id,
+					GoogleId:     user.Id,
+					Method:       "PATCH",
+					Attributes:   append(sortedKeys(value), mappedAttributes...),
+					Payload:      payload,
+					Note:         note,
+				})
+				keeperUser.Email = email
+				keeperUser.ExternalId = user.Id
+				keeperUser.FullName = user.FullName
+				keeperUser.FirstName = user.FirstName
+				keeperUser.LastName = user.LastName
+				if _, ok = value["active"]; ok {
 					keeperUser.Active = user.Active
-					successes = append(successes, fmt.Sprintf("SCIM updated user \"%s\"", user.Email))
-				} else {
-					failures = append(failures, fmt.Sprintf("PATCH user \"%s\" error: %s", user.Email, er1.Error()))
+				}
+				for _, attribute := range mappedAttributes {
+					setScimAttribute(keeperUser.Resource, attribute, attributes[attribute])
 				}
 			}
+			if s.state != nil {
+				s.state.UserLinks[user.Id] = keeperUser.Id
+			}
+			linked[user.Id] = keeperUser
 			delete(externalUsers, user.Id)
 			delete(keeperUsers, keeperUser.Id)
 		}
 	}
 
 	if len(externalUsers) > 0 {
-		for _, user := range externalUsers {
+		for _, userId := range sortedUserIds(externalUsers) {
+			var user = externalUsers[userId]
 			if !user.Active {
 				continue
 			}
 			var payload = make(map[string]any)
-			payload["schemas"] = []string{"urn:ietf:params:scim:schemas:core:2.0:User",
+			payload["schemas"] = []any{"urn:ietf:params:scim:schemas:core:2.0:User",
 				"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"}
-			payload["userName"] = user.Email
+			var email = s.keeperEmail(user.Email)
+			payload["userName"] = email
 			payload["externalId"] = user.Id
 			payload["displayName"] = user.FullName
 			var name = make(map[string]any)
@@ -292,57 +795,321 @@ func (s *sync) syncUsers() (successes []string, failures []string, err error) {
 			name["familyName"] = user.LastName
 			payload["name"] = name
 			payload["active"] = user.Active
-			if payload, er1 = s.postResource("Users", payload); er1 == nil {
-				if au := parseScimUser(payload); au != nil {
-					s.scimUsers[au.Id] = au
+			var attributes = s.userAttributes(user, userLookup, cycles)
+			for _, attribute := range sortedKeys(attributes) {
+				if value := attributes[attribute]; value != nil {
+					setScimAttribute(payload, attribute, value)
 				}
-				successes = append(successes, fmt.Sprintf("SCIM added user \"%s\"", user.Email))
-			} else {
-				failures = append(failures, fmt.Sprintf("POST user \"%s\" error: %s", user.Email, er1.Error()))
 			}
+
+			var keeperId = PendingKeeperId(UsersResource, user.Id)
+			plan.Operations = append(plan.Operations, &PlannedOperation{
+				Kind:         CreateOperation,
+				ResourceType: UsersResource,
+				Name:         email,
+				KeeperId:     keeperId,
+				GoogleId:     user.Id,
+				Method:       "POST",
+				Payload:      payload,
+			})
+			var su = new(scimUser)
+			su.Id = keeperId
+			su.Email = email
+			su.ExternalId = user.Id
+			su.FullName = user.FullName
+			su.FirstName = user.FirstName
+			su.LastName = user.LastName
+			su.Active = user.Active
+			su.Resource = cloneResource(payload)
+			s.scimUsers[su.Id] = su
+			userLookup[fold.String(su.Email)] = su
+			linked[user.Id] = su
 		}
 	}
+	s.planManagers(plan, sourceUsers, linked, userLookup, cycles)
+	var missingUsers = NewSet[string]()
 	if len(keeperUsers) > 0 {
-		for _, user := range keeperUsers {
-			if !user.Active {
+		var now = time.Now()
+		for _, userId := range sortedKeys(keeperUsers) {
+			var user = keeperUsers[userId]
+			var op *PlannedOperation
+			if user.Active {
+				missingUsers.Add(user.Id)
+				if s.gracePeriod > 0 && s.state != nil {
+					var missingSince, ok = s.state.MissingSince[user.Id]
+					if !ok {
+						missingSince = now
+						s.state.MissingSince[user.Id] = now
+					}
+					if now.Sub(missingSince) < s.gracePeriod {
+						var kind, method = DeleteOperation, "DELETE"
+						if s.deprovision == DeactivateDeprovision {
+							kind, method = DeactivateOperation, "PATCH"
+						}
+						plan.Operations = append(plan.Operations, &PlannedOperation{
+							Kind:         kind,
+							ResourceType: UsersResource,
+							Name:         user.Email,
+							KeeperId:     user.Id,
+							GoogleId:     user.ExternalId,
+							Method:       method,
+							SkipReason: fmt.Sprintf("%s postponed until %s: grace period for users missing from the SCIM scope",
+								kind, missingSince.Add(s.gracePeriod).UTC().Format(time.RFC3339)),
+						})
+						continue
+					}
+				}
+				if s.deprovision == DeactivateDeprovision {
+					var value = make(map[string]any)
+					value["active"] = false
+					var pop = make(map[string]any)
+					pop["op"] = "replace"
+					pop["value"] = value
+					var payload = make(map[string]any)
+					payload["schemas"] = []any{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}
+					payload["Operations"] = []any{pop}
+					op = &PlannedOperation{
+						Kind:         DeactivateOperation,
+						ResourceType: UsersResource,
+						Name:         user.Email,
+						KeeperId:     user.Id,
+						GoogleId:     user.ExternalId,
+						Method:       "PATCH",
+						Attributes:   []string{"active"},
+						Payload:      payload,
+					}
+				} else {
+					op = &PlannedOperation{
+						Kind:         DeleteOperation,
+						ResourceType: UsersResource,
+						Name:         user.Email,
+						KeeperId:     user.Id,
+						GoogleId:     user.ExternalId,
+						Method:       "DELETE",
+					}
+				}
+			} else {
+				// a user deactivated by the sync is hard-deleted once it has been inactive long enough
+				if s.deprovision != DeactivateDeprovision || s.deleteAfter <= 0 || s.state == nil {
+					continue
+				}
+				var deactivated, ok = s.state.DeactivatedAt[user.Id]
+				if !ok || now.Sub(deactivated) < s.deleteAfter {
+					continue
+				}
+				op = &PlannedOperation{
+					Kind:         DeleteOperation,
+					ResourceType: UsersResource,
+					Name:         user.Email,
+					KeeperId:     user.Id,
+					GoogleId:     user.ExternalId,
+					Method:       "DELETE",
+				}
+			}
+			if protection := s.protectionOf(user, nil); len(protection) > 0 {
+				op.SkipReason = fmt.Sprintf("%s blocked: %s", op.Kind, protection)
+				op.Payload = nil
+				plan.Operations = append(plan.Operations, op)
 				continue
 			}
 			if s.destructive >= 0 {
-				if er1 = s.deleteResource("Users", user.Id); er1 == nil {
+				if op.Kind == DeleteOperation {
 					delete(s.scimUsers, user.Id)
-					successes = append(successes, fmt.Sprintf("SCIM deleted user \"%s\"", user.Email))
 				} else {
-					failures = append(failures, fmt.Sprintf("DELETE user \"%s\" error: %s", user.Email, er1.Error()))
+					user.Active = false
 				}
 			} else {
-				failures = append(failures, fmt.Sprintf("DELETE user \"%s\": delete skipped since the \"Safe Mode\" is enforced", user.Email))
+				op.SkipReason = fmt.Sprintf("%s skipped since the \"Safe Mode\" is enforced", op.Kind)
+			}
+			plan.Operations = append(plan.Operations, op)
+		}
+	}
+	if s.state != nil {
+		// forget users that came back to the SCIM scope or no longer exist
+		for userId := range s.state.MissingSince {
+			if !missingUsers.Has(userId) {
+				delete(s.state.MissingSince, userId)
+			}
+		}
+		if s.gracePeriod > 0 {
+			plan.MissingSince = make(map[string]time.Time)
+			for userId, missingSince := range s.state.MissingSince {
+				plan.MissingSince[userId] = missingSince
 			}
 		}
 	}
 	return
 }
 
-func (s *sync) syncMembership() (successes []string, failures []string, err error) {
+// userAlias returns the Google user alias that corresponds to a Keeper username
+func (s *sync) userAlias(user *User, keeperEmail string) string {
+	var key = cases.Fold().String(keeperEmail)
+	for _, alias := range user.Aliases {
+		if s.userKey(alias) == key {
+			return alias
+		}
+	}
+	return ""
+}
+
+// userConflict is a Google user that cannot be matched to a Keeper user unambiguously
+type userConflict struct {
+	user   *User
+	users  []*scimUser
+	reason string
+}
+
+func describeUsers(users []*scimUser) string {
+	var names []string
+	for _, user := range users {
+		names = append(names, fmt.Sprintf("\"%s\" (%s)", user.Email, user.Id))
+	}
+	return strings.Join(names, ", ")
+}
+
+// matchUsers finds Keeper users for Google users. Keeper users are matched by external ID first, then by email,
+// then by Google user aliases. The results are keyed by Google user ID. aliases holds the alias a Keeper user was matched by
+// A Google user is reported as a conflict if several Keeper users share its ID as the external ID
+func (s *sync) matchUsers(users map[string]*User) (matches map[string]*scimUser, aliases map[string]string, conflicts []*userConflict) {
+	matches = make(map[string]*scimUser)
+	aliases = make(map[string]string)
 	var fold = cases.Fold()
-	var keeperUserLookup = make(map[string]*scimUser)
-	for _, v := range s.scimUsers {
-		keeperUserLookup[fold.String(v.Email)] = v
+	var byExternalId = make(map[string][]*scimUser)
+	var byEmail = make(map[string]*scimUser)
+	for _, keeperId := range sortedKeys(s.scimUsers) {
+		var v = s.scimUsers[keeperId]
+		if len(v.ExternalId) > 0 {
+			byExternalId[v.ExternalId] = append(byExternalId[v.ExternalId], v)
+		}
+		byEmail[fold.String(v.Email)] = v
+	}
+	var claimed = NewSet[string]()
+	var userIds = sortedUserIds(users)
+	for _, userId := range userIds {
+		var user = users[userId]
+		var keeperUsers = byExternalId[user.Id]
+		switch len(keeperUsers) {
+		case 0:
+		case 1:
+			matches[user.Id] = keeperUsers[0]
+			claimed.Add(keeperUsers[0].Id)
+		default:
+			conflicts = append(conflicts, &userConflict{
+				user:   user,
+				users:  keeperUsers,
+				reason: fmt.Sprintf("Keeper users %s are linked to the same Google user", describeUsers(keeperUsers)),
+			})
+			for _, keeperUser := range keeperUsers {
+				claimed.Add(keeperUser.Id)
+			}
+		}
+	}
+	var conflicted = NewSet[string]()
+	for _, conflict := range conflicts {
+		conflicted.Add(conflict.user.Id)
 	}
+	for _, userId := range userIds {
+		var user = users[userId]
+		if _, ok := matches[user.Id]; ok || conflicted.Has(user.Id) {
+			continue
+		}
+		if keeperUser, ok := byEmail[s.userKey(user.Email)]; ok && !claimed.Has(keeperUser.Id) {
+			matches[user.Id] = keeperUser
+			claimed.Add(keeperUser.Id)
+		}
+	}
+	for _, userId := range userIds {
+		var user = users[userId]
+		if _, ok := matches[user.Id]; ok || conflicted.Has(user.Id) {
+			continue
+		}
+		for _, alias := range user.Aliases {
+			if keeperUser, ok := byEmail[s.userKey(alias)]; ok && !claimed.Has(keeperUser.Id) {
+				matches[user.Id] = keeperUser
+				aliases[user.Id] = alias
+				claimed.Add(keeperUser.Id)
+				break
+			}
+		}
+	}
+	return
+}
+
+func (s *sync) planMembership(plan *SyncPlan) (err error) {
+	var sourceUsers = make(map[string]*User)
+	s.source.Users(func(user *User) {
+		sourceUsers[user.Id] = user
+	})
+	var matches, _, _ = s.matchUsers(sourceUsers)
 	var keeperGroupMap = make(map[string]string)
+	var excludedGroupMap = make(map[string]string)
 	for _, v := range s.scimGroups {
-		keeperGroupMap[v.ExternalId] = v.Id
+		if _, ok := s.excludedTeams[v.Id]; ok {
+			if len(v.ExternalId) > 0 {
+				excludedGroupMap[v.ExternalId] = v.Id
+			}
+		} else if !s.ambiguousTeams.Has(v.Id) {
+			keeperGroupMap[v.ExternalId] = v.Id
+		}
 	}
 	var ok bool
 	var keeperUser *scimUser
 	var keeperGroup *scimGroup
-	s.source.Users(func(user *User) {
-		if keeperUser, ok = keeperUserLookup[fold.String(user.Email)]; !ok {
-			return
+	for _, userId := range sortedUserIds(sourceUsers) {
+		var user = sourceUsers[userId]
+		if _, ok = s.excludedUsers[user.Id]; ok {
+			continue
+		}
+		if keeperUser, ok = matches[user.Id]; !ok {
+			continue
+		}
+		if s.isUserUnchanged(user, keeperUser) {
+			// teams created by this plan need membership regardless
+			var hasNewTeams = false
+			for _, externalGroupId := range s.userTeams(user) {
+				if isPendingKeeperId(keeperGroupMap[externalGroupId]) {
+					hasNewTeams = true
+					break
+				}
+			}
+			if !hasNewTeams {
+				continue
+			}
 		}
 		var keeperGroupId string
 		var keeperUserGroups = MakeSet[string](keeperUser.Groups)
+		// membership of teams with ambiguous match is left untouched
+		keeperUserGroups.Difference(s.ambiguousTeams.ToArray())
+		var membershipOp = func(reason string) *PlannedOperation {
+			return &PlannedOperation{
+				Kind:         MembershipOperation,
+				ResourceType: UsersResource,
+				Name:         keeperUser.Email,
+				KeeperId:     keeperUser.Id,
+				GoogleId:     user.Id,
+				Method:       "PATCH",
+				SkipReason:   reason,
+			}
+		}
+		// membership of excluded teams is left untouched
+		var sourceTeams = NewSet[string]()
+		for _, groupId := range user.Groups {
+			sourceTeams.Add(groupId)
+			if teamId, ok := s.groupTeams[groupId]; ok {
+				sourceTeams.Add(teamId)
+			}
+		}
+		for _, keeperGroupId = range sortedKeys(keeperUserGroups) {
+			if entry, ok := s.excludedTeams[keeperGroupId]; ok {
+				keeperUserGroups.Delete(keeperGroupId)
+				if keeperGroup = s.scimGroups[keeperGroupId]; keeperGroup != nil && !sourceTeams.Has(keeperGroup.ExternalId) {
+					plan.Operations = append(plan.Operations, membershipOp(
+						fmt.Sprintf("remove team \"%s\" skipped. Team is %s", keeperGroup.Name, exclusionReason(entry))))
+				}
+			}
+		}
 		var addGroups, removeGroups []string
-		for _, externalGroupId := range user.Groups {
+		for _, externalGroupId := range s.userTeams(user) {
 			if keeperGroupId, ok = keeperGroupMap[externalGroupId]; ok {
 				if keeperUserGroups.Has(keeperGroupId) {
 					keeperUserGroups.Delete(keeperGroupId)
@@ -351,24 +1118,34 @@ func (s *sync) syncMembership() (successes []string, failures []string, err erro
 				}
 			}
 		}
+		sort.Strings(addGroups)
+		var keeperMembership = MakeSet[string](keeperUser.Groups)
+		for _, externalGroupId := range sortedKeys(sourceTeams) {
+			if keeperGroupId, ok = excludedGroupMap[externalGroupId]; ok && !keeperMembership.Has(keeperGroupId) {
+				keeperMembership.Add(keeperGroupId)
+				plan.Operations = append(plan.Operations, membershipOp(
+					fmt.Sprintf("add team \"%s\" skipped. Team is %s", s.scimGroups[keeperGroupId].Name,
+						exclusionReason(s.excludedTeams[keeperGroupId]))))
+			}
+		}
 		if len(keeperUserGroups) > 0 {
-			if s.destructive > 0 {
-				removeGroups = append(removeGroups, keeperUserGroups.ToArray()...)
-			} else {
-				for keeperGroupId = range keeperUserGroups {
-					if keeperGroup, ok = s.scimGroups[keeperGroupId]; ok {
-						if len(keeperGroup.ExternalId) > 0 {
-							removeGroups = append(removeGroups, keeperGroupId)
-						} else {
-							if s.verbose {
-								failures = append(failures, fmt.Sprintf("Remove team \"%s\" from user \"%s\" skipped. Team is not controlled by SCIM", keeperGroup.Name, user.Email))
-							}
-						}
-					} else {
-						if s.verbose {
-							failures = append(failures, fmt.Sprintf("Remove team Id \"%s\" from user \"%s\" skipped. Team is outside of SCIM node", keeperGroupId, user.Email))
+			for _, keeperGroupId = range sortedKeys(keeperUserGroups) {
+				if keeperGroup, ok = s.scimGroups[keeperGroupId]; ok {
+					if len(keeperGroup.ExternalId) > 0 || (s.destructive > 0 && s.isManagedTeamName(keeperGroup.Name)) {
+						removeGroups = append(removeGroups, keeperGroupId)
+					} else if s.verbose {
+						var reason = "Team is not controlled by SCIM"
+						if s.destructive > 0 {
+							reason = "Team is outside of the \"Team Name Template\" namespace"
 						}
+						plan.Operations = append(plan.Operations, membershipOp(
+							fmt.Sprintf("remove team \"%s\" skipped. %s", keeperGroup.Name, reason)))
 					}
+				} else if s.destructive > 0 {
+					removeGroups = append(removeGroups, keeperGroupId)
+				} else if s.verbose {
+					plan.Operations = append(plan.Operations, membershipOp(
+						fmt.Sprintf("remove team Id \"%s\" skipped. Team is outside of SCIM node", keeperGroupId)))
 				}
 			}
 		}
@@ -401,21 +1178,23 @@ func (s *sync) syncMembership() (successes []string, failures []string, err erro
 					op["value"] = values
 					operations = append(operations, op)
 				} else {
-					failures = append(failures, fmt.Sprintf("REMOVE membership for user \"%s\" skipped since the \"Safe Mode\" is enforced", user.Email))
+					plan.Operations = append(plan.Operations, membershipOp(
+						"remove membership skipped since the \"Safe Mode\" is enforced"))
 				}
 			}
+			if len(operations) == 0 {
+				continue
+			}
 
 			var payload = make(map[string]any)
-			payload["schemas"] = []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}
+			payload["schemas"] = []any{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}
 			payload["Operations"] = operations
 
-			if er1 := s.patchResource("Users", keeperUser.Id, payload); er1 == nil {
-				successes = append(successes, fmt.Sprintf("SCIM changed user \"%s\" membership: %d added; %d removed", keeperUser.Email, len(addGroups), len(removeGroups)))
-			} else {
-				failures = append(failures, fmt.Sprintf("PATCH user \"%s\" membership error: %s", keeperUser.Email, er1.Error()))
-			}
+			var op = membershipOp("")
+			op.Payload = payload
+			plan.Operations = append(plan.Operations, op)
 		}
-	})
+	}
 
 	return
 }
@@ -0,0 +1,957 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+// testSource is ICrmDataSource with predefined users and groups
+type testSource struct {
+	users  []*User
+	groups []*Group
+	logger SyncDebugLogger
+}
+
+func (ts *testSource) Users(cb func(*User)) {
+	for _, u := range ts.users {
+		cb(u)
+	}
+}
+func (ts *testSource) Groups(cb func(*Group)) {
+	for _, g := range ts.groups {
+		cb(g)
+	}
+}
+func (ts *testSource) Populate(context.Context) error        { return nil }
+func (ts *testSource) DebugLogger() SyncDebugLogger          { return ts.logger }
+func (ts *testSource) SetDebugLogger(logger SyncDebugLogger) { ts.logger = logger }
+func (ts *testSource) LoadErrors() bool                      { return false }
+func (ts *testSource) Warnings() []string                    { return nil }
+func (ts *testSource) ProtectedUsers(func(*User))            {}
+
+// testScim is an in-memory SCIM endpoint
+type testScim struct {
+	mu       gosync.Mutex
+	users    map[string]map[string]any
+	groups   map[string]map[string]any
+	next     int
+	requests []string
+}
+
+func newTestScim(users []map[string]any, groups []map[string]any) *testScim {
+	var ts = &testScim{
+		users:  make(map[string]map[string]any),
+		groups: make(map[string]map[string]any),
+	}
+	for _, u := range users {
+		ts.users[u["id"].(string)] = u
+	}
+	for _, g := range groups {
+		ts.groups[g["id"].(string)] = g
+	}
+	return ts
+}
+
+func (ts *testScim) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var path = strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var resourceType, id = path[0], ""
+	if len(path) > 1 {
+		id = path[1]
+	}
+	var resources = ts.users
+	if resourceType == "Groups" {
+		resources = ts.groups
+	}
+	var body map[string]any
+	if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+		_ = json.Unmarshal(data, &body)
+	}
+	if r.Method == "POST" {
+		ts.next++
+		id = fmt.Sprintf("%s-%d", strings.ToLower(resourceType), ts.next)
+	}
+	ts.requests = append(ts.requests, strings.TrimSuffix(r.Method+" "+resourceType+"/"+id, "/"))
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		var list []any
+		for _, key := range sortedKeys(resources) {
+			list = append(list, resources[key])
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"Resources": list, "itemsPerPage": len(list), "startIndex": 1, "totalResults": len(list)})
+	case "POST":
+		body["id"] = id
+		resources[id] = body
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(body)
+	case "PATCH":
+		var resource, ok = resources[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var operations, _ = body["Operations"].([]any)
+		for _, o := range operations {
+			var op = o.(map[string]any)
+			if path, _ := op["path"].(string); len(path) == 0 {
+				if values, ok := op["value"].(map[string]any); ok {
+					for k, v := range values {
+						resource[k] = v
+					}
+				}
+				continue
+			} else if path != "groups" {
+				resource[path] = op["value"]
+				continue
+			}
+			var groups, _ = resource["groups"].([]any)
+			for _, v := range op["value"].([]any) {
+				var groupId = v.(map[string]any)["value"]
+				if _, ok = ts.groups[groupId.(string)]; !ok {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if op["op"] == "add" {
+					groups = append(groups, map[string]any{"value": groupId})
+				}
+			}
+			resource["groups"] = groups
+		}
+		_ = json.NewEncoder(w).Encode(resource)
+	case "DELETE":
+		delete(resources, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// newScimSync creates the sync against the test SCIM endpoint
+func newScimSync(t *testing.T, source *testSource, scim *testScim) *sync {
+	var server = httptest.NewServer(scim)
+	t.Cleanup(server.Close)
+	return NewScimSync(source, server.URL, "token").(*sync)
+}
+
+// newTestSync creates the sync with source and SCIM data loaded
+func newTestSync(t *testing.T, source *testSource, scim *testScim) *sync {
+	var s = newScimSync(t, source, scim)
+	if err := s.populateSource(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.populateScim(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// describeOperations renders planned operations as "<kind> <method> <keeper id or name>"
+func describeOperations(operations []*PlannedOperation) (result []string) {
+	for _, op := range operations {
+		var target = op.KeeperId
+		if len(target) == 0 {
+			target = op.Name
+		}
+		var line = fmt.Sprintf("%s %s %s", op.Kind, op.Method, target)
+		if len(op.SkipReason) > 0 {
+			line += " (skipped)"
+		}
+		result = append(result, line)
+	}
+	return
+}
+
+func scimUserObject(id string, email string, externalId string, groups ...string) map[string]any {
+	var user = map[string]any{
+		"id":          id,
+		"userName":    email,
+		"externalId":  externalId,
+		"displayName": email,
+		"active":      true,
+	}
+	var values []any
+	for _, groupId := range groups {
+		values = append(values, map[string]any{"value": groupId})
+	}
+	if len(values) > 0 {
+		user["groups"] = values
+	}
+	return user
+}
+
+func scimGroupObject(id string, name string, externalId string) map[string]any {
+	return map[string]any{
+		"id":          id,
+		"displayName": name,
+		"externalId":  externalId,
+	}
+}
+
+func TestPlanGroups(t *testing.T) {
+	var tests = []struct {
+		name        string
+		destructive int32
+		groups      []*Group
+		teams       []map[string]any
+		expected    []string
+	}{
+		{
+			name: "creates are ordered by Google ID",
+			groups: []*Group{
+				{Id: "g3", Name: "Sales"},
+				{Id: "g1", Name: "Engineering"},
+				{Id: "g2", Name: "Marketing"},
+			},
+			expected: []string{
+				"create POST " + PendingKeeperId(GroupsResource, "g1"),
+				"create POST " + PendingKeeperId(GroupsResource, "g2"),
+				"create POST " + PendingKeeperId(GroupsResource, "g3"),
+			},
+		},
+		{
+			name:        "deletes are ordered by Keeper ID",
+			destructive: 1,
+			teams: []map[string]any{
+				scimGroupObject("t3", "Sales", "g3"),
+				scimGroupObject("t1", "Engineering", "g1"),
+				scimGroupObject("t2", "Marketing", ""),
+			},
+			expected: []string{
+				"delete DELETE t1",
+				"delete DELETE t2",
+				"delete DELETE t3",
+			},
+		},
+		{
+			name: "teams not controlled by SCIM are kept",
+			teams: []map[string]any{
+				scimGroupObject("t2", "Marketing", "g2"),
+				scimGroupObject("t1", "Engineering", ""),
+			},
+			expected: []string{
+				"delete DELETE t2",
+			},
+		},
+		{
+			name:        "safe mode skips deletes",
+			destructive: -1,
+			teams: []map[string]any{
+				scimGroupObject("t1", "Engineering", "g1"),
+			},
+			expected: []string{
+				"delete DELETE t1 (skipped)",
+			},
+		},
+		{
+			name: "matched teams are linked and renamed",
+			groups: []*Group{
+				{Id: "g2", Name: "Marketing Team"},
+				{Id: "g1", Name: "Engineering"},
+			},
+			teams: []map[string]any{
+				scimGroupObject("t2", "Marketing", "g2"),
+				scimGroupObject("t1", "engineering", ""),
+			},
+			expected: []string{
+				"update PATCH t1",
+				"update PATCH t2",
+			},
+		},
+		{
+			name: "teams sharing a name are ambiguous",
+			groups: []*Group{
+				{Id: "g1", Name: "Engineering"},
+			},
+			teams: []map[string]any{
+				scimGroupObject("t2", "Engineering", ""),
+				scimGroupObject("t1", "Engineering", ""),
+			},
+			expected: []string{
+				"update PATCH Engineering (skipped)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s = newTestSync(t, &testSource{groups: tt.groups}, newTestScim(nil, tt.teams))
+			s.destructive = tt.destructive
+			var plan = new(SyncPlan)
+			if err := s.planGroups(plan); err != nil {
+				t.Fatal(err)
+			}
+			if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("operations:\n%s\nexpected:\n%s", strings.Join(actual, "\n"), strings.Join(tt.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestPlanUsers(t *testing.T) {
+	var tests = []struct {
+		name        string
+		destructive int32
+		deprovision DeprovisionPolicy
+		users       []*User
+		keeperUsers []map[string]any
+		expected    []string
+	}{
+		{
+			name: "creates are ordered by email",
+			users: []*User{
+				{Id: "u1", Email: "carol@company.com", FullName: "carol@company.com", Active: true},
+				{Id: "u2", Email: "alice@company.com", FullName: "alice@company.com", Active: true},
+				{Id: "u3", Email: "bob@company.com", FullName: "bob@company.com", Active: true},
+				{Id: "u4", Email: "dave@company.com", FullName: "dave@company.com"},
+			},
+			expected: []string{
+				"create POST " + PendingKeeperId(UsersResource, "u2"),
+				"create POST " + PendingKeeperId(UsersResource, "u3"),
+				"create POST " + PendingKeeperId(UsersResource, "u1"),
+			},
+		},
+		{
+			name: "updates are ordered by email",
+			users: []*User{
+				{Id: "u1", Email: "carol@company.com", FullName: "Carol", Active: true},
+				{Id: "u2", Email: "alice@company.com", FullName: "Alice", Active: true},
+				{Id: "u3", Email: "bob@company.com", FullName: "bob@company.com", Active: true},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "carol@company.com", "u1"),
+				scimUserObject("k2", "alice@company.com", ""),
+				scimUserObject("k3", "bob@company.com", "u3"),
+			},
+			expected: []string{
+				"update PATCH k2",
+				"update PATCH k1",
+			},
+		},
+		{
+			name: "deletes are ordered by Keeper ID",
+			keeperUsers: []map[string]any{
+				scimUserObject("k3", "carol@company.com", "u3"),
+				scimUserObject("k1", "alice@company.com", "u1"),
+				scimUserObject("k2", "bob@company.com", "u2"),
+			},
+			expected: []string{
+				"delete DELETE k1",
+				"delete DELETE k2",
+				"delete DELETE k3",
+			},
+		},
+		{
+			name:        "deactivation",
+			deprovision: DeactivateDeprovision,
+			keeperUsers: []map[string]any{
+				scimUserObject("k2", "bob@company.com", "u2"),
+				scimUserObject("k1", "alice@company.com", "u1"),
+			},
+			expected: []string{
+				"deactivate PATCH k1",
+				"deactivate PATCH k2",
+			},
+		},
+		{
+			name:        "safe mode skips deletes",
+			destructive: -1,
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "alice@company.com", "u1"),
+			},
+			expected: []string{
+				"delete DELETE k1 (skipped)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s = newTestSync(t, &testSource{users: tt.users}, newTestScim(tt.keeperUsers, nil))
+			s.destructive = tt.destructive
+			s.SetDeprovision(tt.deprovision)
+			var plan = new(SyncPlan)
+			if err := s.planUsers(plan); err != nil {
+				t.Fatal(err)
+			}
+			if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("operations:\n%s\nexpected:\n%s", strings.Join(actual, "\n"), strings.Join(tt.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestPlanMembership(t *testing.T) {
+	var teams = []map[string]any{
+		scimGroupObject("t1", "Engineering", "g1"),
+		scimGroupObject("t2", "Marketing", "g2"),
+		scimGroupObject("t3", "Sales", "g3"),
+		scimGroupObject("t4", "Support", ""),
+	}
+	var tests = []struct {
+		name        string
+		destructive int32
+		users       []*User
+		keeperUsers []map[string]any
+		expected    []string
+		payloads    []string
+	}{
+		{
+			name: "teams are added in Keeper ID order",
+			users: []*User{
+				{Id: "u1", Email: "bob@company.com", Groups: []string{"g3", "g1", "g2"}},
+				{Id: "u2", Email: "alice@company.com", Groups: []string{"g2"}},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "bob@company.com", "u1", "t2"),
+				scimUserObject("k2", "alice@company.com", "u2"),
+			},
+			expected: []string{
+				"membership PATCH k2",
+				"membership PATCH k1",
+			},
+			payloads: []string{
+				"add t2",
+				"add t1,t3",
+			},
+		},
+		{
+			name: "teams not controlled by SCIM are kept",
+			users: []*User{
+				{Id: "u1", Email: "bob@company.com"},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "bob@company.com", "u1", "t4", "t3", "t1"),
+			},
+			expected: []string{
+				"membership PATCH k1",
+			},
+			payloads: []string{
+				"remove t1,t3",
+			},
+		},
+		{
+			name:        "all teams are removed in destructive mode",
+			destructive: 1,
+			users: []*User{
+				{Id: "u1", Email: "bob@company.com", Groups: []string{"g2"}},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "bob@company.com", "u1", "t4", "t3", "t1"),
+			},
+			expected: []string{
+				"membership PATCH k1",
+			},
+			payloads: []string{
+				"add t2; remove t1,t3,t4",
+			},
+		},
+		{
+			name:        "safe mode skips removal",
+			destructive: -1,
+			users: []*User{
+				{Id: "u1", Email: "bob@company.com"},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "bob@company.com", "u1", "t1"),
+			},
+			expected: []string{
+				"membership PATCH k1 (skipped)",
+			},
+			payloads: []string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var groups []*Group
+			for _, team := range teams {
+				if externalId := team["externalId"].(string); len(externalId) > 0 {
+					groups = append(groups, &Group{Id: externalId, Name: team["displayName"].(string)})
+				}
+			}
+			var s = newTestSync(t, &testSource{users: tt.users, groups: groups}, newTestScim(tt.keeperUsers, teams))
+			s.destructive = tt.destructive
+			var plan = new(SyncPlan)
+			if err := s.planMembership(plan); err != nil {
+				t.Fatal(err)
+			}
+			if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("operations:\n%s\nexpected:\n%s", strings.Join(actual, "\n"), strings.Join(tt.expected, "\n"))
+			}
+			var payloads []string
+			for _, op := range plan.Operations {
+				payloads = append(payloads, describeMembership(op.Payload))
+			}
+			if !reflect.DeepEqual(payloads, tt.payloads) {
+				t.Errorf("payloads: %q, expected: %q", payloads, tt.payloads)
+			}
+		})
+	}
+}
+
+// describeMembership renders a membership patch as "add t1,t2; remove t3"
+func describeMembership(payload map[string]any) string {
+	var operations, _ = payload["Operations"].([]any)
+	var result []string
+	for _, o := range operations {
+		var op = o.(map[string]any)
+		var ids []string
+		for _, v := range op["value"].([]any) {
+			ids = append(ids, v.(map[string]any)["value"].(string))
+		}
+		result = append(result, fmt.Sprintf("%s %s", op["op"], strings.Join(ids, ",")))
+	}
+	return strings.Join(result, "; ")
+}
+
+func TestPlanIsDeterministic(t *testing.T) {
+	var source = &testSource{}
+	var keeperUsers []map[string]any
+	for i := 0; i < 20; i++ {
+		source.groups = append(source.groups, &Group{Id: fmt.Sprintf("g%02d", i), Name: fmt.Sprintf("Team %02d", i)})
+		source.users = append(source.users, &User{
+			Id:     fmt.Sprintf("u%02d", i),
+			Email:  fmt.Sprintf("user%02d@company.com", i),
+			Active: true,
+			Groups: []string{fmt.Sprintf("g%02d", (i+1)%20), fmt.Sprintf("g%02d", i)},
+		})
+		keeperUsers = append(keeperUsers, scimUserObject(fmt.Sprintf("k%02d", i), fmt.Sprintf("gone%02d@company.com", i), fmt.Sprintf("x%02d", i)))
+	}
+	var expected []byte
+	for i := 0; i < 5; i++ {
+		var s = newTestSync(t, source, newTestScim(keeperUsers, nil))
+		var plan = new(SyncPlan)
+		if err := s.planGroups(plan); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.planUsers(plan); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.planMembership(plan); err != nil {
+			t.Fatal(err)
+		}
+		var actual, _ = json.Marshal(plan.Operations)
+		if expected == nil {
+			expected = actual
+		} else if string(actual) != string(expected) {
+			t.Fatalf("plan %d differs from the first plan", i)
+		}
+	}
+}
+
+func TestDeleteDeactivatedAfter(t *testing.T) {
+	var source = &testSource{users: []*User{
+		{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true},
+	}}
+	var server = newTestScim([]map[string]any{
+		scimUserObject("k1", "alice@company.com", "u1"),
+		scimUserObject("k2", "bob@company.com", "u2"),
+		scimUserObject("k3", "carol@company.com", ""),
+	}, nil)
+	server.users["k3"]["active"] = false
+	var store = NewMemoryStateStore()
+	var run = func() *SyncStat {
+		var s = newScimSync(t, source, server)
+		s.SetStateStore(store)
+		s.SetDeprovision(DeactivateDeprovision)
+		s.SetDeleteDeactivatedAfter(24 * time.Hour)
+		var stat, err = s.Sync(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat
+	}
+
+	var stat = run()
+	if stat.Users.Deactivated != 1 || stat.Users.Deleted != 0 {
+		t.Fatalf("first run: %d deactivated, %d deleted", stat.Users.Deactivated, stat.Users.Deleted)
+	}
+	var state, _ = store.Load()
+	if _, ok := state.DeactivatedAt["k2"]; !ok {
+		t.Fatal("deactivation time is not recorded")
+	}
+
+	stat = run()
+	if stat.Users.Deactivated != 0 || stat.Users.Deleted != 0 {
+		t.Fatalf("run within the delay: %d deactivated, %d deleted", stat.Users.Deactivated, stat.Users.Deleted)
+	}
+
+	state, _ = store.Load()
+	state.DeactivatedAt["k2"] = time.Now().Add(-48 * time.Hour)
+	_ = store.Save(state)
+	stat = run()
+	if stat.Users.Deleted != 1 {
+		t.Fatalf("run after the delay: %d deleted", stat.Users.Deleted)
+	}
+	if _, ok := server.users["k2"]; ok {
+		t.Error("user deactivated by the sync is not deleted")
+	}
+	if _, ok := server.users["k3"]; !ok {
+		t.Error("user deactivated manually is deleted")
+	}
+	state, _ = store.Load()
+	if len(state.DeactivatedAt) != 0 {
+		t.Errorf("deactivation times: %v", state.DeactivatedAt)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	var source = &testSource{users: []*User{
+		{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true},
+	}}
+	var server = newTestScim([]map[string]any{
+		scimUserObject("k1", "alice@company.com", "u1"),
+		scimUserObject("k2", "bob@company.com", "u2"),
+		scimUserObject("k3", "carol@company.com", "u3"),
+	}, nil)
+	var store = NewMemoryStateStore()
+	var newSync = func() *sync {
+		var s = newScimSync(t, source, server)
+		s.SetStateStore(store)
+		s.SetGracePeriod(24 * time.Hour)
+		return s
+	}
+
+	var plan, err = newSync().Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{"delete DELETE k2 (skipped)", "delete DELETE k3 (skipped)"}
+	if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("plan: %v, expected: %v", actual, expected)
+	}
+	var state, _ = store.Load()
+	if len(state.MissingSince) > 0 {
+		t.Error("Plan stores the grace period clocks")
+	}
+	if _, err = newSync().Apply(context.Background(), plan); err != nil {
+		t.Fatal(err)
+	}
+	state, _ = store.Load()
+	if len(state.MissingSince) != 2 {
+		t.Fatalf("missing since: %v", state.MissingSince)
+	}
+
+	// k3 comes back to the scope while the grace period of k2 expires
+	source.users = append(source.users, &User{Id: "u3", Email: "carol@company.com", FullName: "carol@company.com", Active: true})
+	state.MissingSince["k2"] = time.Now().Add(-48 * time.Hour)
+	_ = store.Save(state)
+	var stat *SyncStat
+	if stat, err = newSync().Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Users.Deleted != 1 {
+		t.Errorf("%d user(s) deleted", stat.Users.Deleted)
+	}
+	if _, ok := server.users["k2"]; ok {
+		t.Error("user is not deleted after the grace period")
+	}
+	state, _ = store.Load()
+	if len(state.MissingSince) != 0 {
+		t.Errorf("missing since: %v", state.MissingSince)
+	}
+}
+
+func TestResumeKeepsDeactivationTimes(t *testing.T) {
+	var source = &testSource{users: []*User{
+		{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true},
+	}}
+	var server = newTestScim([]map[string]any{
+		scimUserObject("k1", "alice@company.com", "u1"),
+		scimUserObject("k2", "bob@company.com", "u2"),
+	}, nil)
+	server.users["k2"]["active"] = false
+	var deactivatedAt = time.Now().Add(-time.Hour).UTC()
+	var store = NewMemoryStateStore()
+	var s = newScimSync(t, source, server)
+	s.SetStateStore(store)
+	s.SetResume(true)
+	s.SetDeprovision(DeactivateDeprovision)
+	s.SetDeleteDeactivatedAfter(24 * time.Hour)
+	if err := s.populateSource(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Save(&SyncState{
+		DeactivatedAt: map[string]time.Time{"k2": deactivatedAt},
+		Checkpoint: &SyncCheckpoint{
+			SourceHash: s.sourceFingerprint(),
+			Created:    time.Now().UTC(),
+			Plan: &SyncPlan{
+				Version: planVersion,
+				ScimUrl: s.baseUrl,
+				Operations: []*PlannedOperation{
+					{Kind: UpdateOperation, ResourceType: UsersResource, Name: "alice@company.com", KeeperId: "k1", GoogleId: "u1",
+						Method: "PATCH", Payload: map[string]any{"Operations": []any{
+							map[string]any{"op": "replace", "value": map[string]any{"displayName": "Alice"}}}}},
+					{Kind: UpdateOperation, ResourceType: UsersResource, Name: "alice@company.com", KeeperId: "k1", GoogleId: "u1",
+						Method: "PATCH", Payload: map[string]any{"Operations": []any{
+							map[string]any{"op": "replace", "value": map[string]any{"title": "Engineer"}}}}},
+				},
+			},
+			Done: []int{0},
+		},
+	})
+	var stat, err = s.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.Resumed {
+		t.Fatal("sync is not resumed")
+	}
+	var state, _ = store.Load()
+	if actual, ok := state.DeactivatedAt["k2"]; !ok || !actual.Equal(deactivatedAt) {
+		t.Errorf("deactivation times: %v", state.DeactivatedAt)
+	}
+	if state.Checkpoint != nil {
+		t.Error("checkpoint of the completed sync is kept")
+	}
+}
+
+func TestMatchUsers(t *testing.T) {
+	var tests = []struct {
+		name      string
+		users     []*User
+		keepers   []*scimUser
+		matches   map[string]string
+		aliases   map[string]string
+		conflicts []string
+	}{
+		{
+			name:  "external ID takes precedence over email",
+			users: []*User{{Id: "u1", Email: "alice@company.com"}},
+			keepers: []*scimUser{
+				{User: User{Id: "k1", Email: "alice@company.com"}},
+				{User: User{Id: "k2", Email: "alice.old@company.com"}, ExternalId: "u1"},
+			},
+			matches: map[string]string{"u1": "k2"},
+		},
+		{
+			name:  "email match is case insensitive",
+			users: []*User{{Id: "u1", Email: "Alice@Company.com"}},
+			keepers: []*scimUser{
+				{User: User{Id: "k1", Email: "alice@company.com"}},
+			},
+			matches: map[string]string{"u1": "k1"},
+		},
+		{
+			name:  "alias",
+			users: []*User{{Id: "u1", Email: "alice@company.com", Aliases: []string{"ali@company.com"}}},
+			keepers: []*scimUser{
+				{User: User{Id: "k1", Email: "ali@company.com"}},
+			},
+			matches: map[string]string{"u1": "k1"},
+			aliases: map[string]string{"u1": "ali@company.com"},
+		},
+		{
+			name: "Keeper user linked to another Google user is not matched by email",
+			users: []*User{
+				{Id: "u1", Email: "alice@company.com"},
+				{Id: "u2", Email: "bob@company.com"},
+			},
+			keepers: []*scimUser{
+				{User: User{Id: "k1", Email: "alice@company.com"}, ExternalId: "u2"},
+			},
+			matches: map[string]string{"u2": "k1"},
+		},
+		{
+			name:  "Keeper users sharing an external ID",
+			users: []*User{{Id: "u1", Email: "alice@company.com"}},
+			keepers: []*scimUser{
+				{User: User{Id: "k2", Email: "alice@company.com"}, ExternalId: "u1"},
+				{User: User{Id: "k1", Email: "alice.old@company.com"}, ExternalId: "u1"},
+			},
+			matches:   map[string]string{},
+			conflicts: []string{"u1: k1,k2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s = &sync{scimUsers: make(map[string]*scimUser)}
+			for _, keeperUser := range tt.keepers {
+				s.scimUsers[keeperUser.Id] = keeperUser
+			}
+			var users = make(map[string]*User)
+			for _, user := range tt.users {
+				users[user.Id] = user
+			}
+			var matches, aliases, conflicts = s.matchUsers(users)
+			var actual = make(map[string]string)
+			for userId, keeperUser := range matches {
+				actual[userId] = keeperUser.Id
+			}
+			if !reflect.DeepEqual(actual, tt.matches) {
+				t.Errorf("matches: %v, expected: %v", actual, tt.matches)
+			}
+			if tt.aliases == nil {
+				tt.aliases = map[string]string{}
+			}
+			if !reflect.DeepEqual(aliases, tt.aliases) {
+				t.Errorf("aliases: %v, expected: %v", aliases, tt.aliases)
+			}
+			var actualConflicts []string
+			for _, conflict := range conflicts {
+				var ids []string
+				for _, keeperUser := range conflict.users {
+					ids = append(ids, keeperUser.Id)
+				}
+				actualConflicts = append(actualConflicts, fmt.Sprintf("%s: %s", conflict.user.Id, strings.Join(ids, ",")))
+			}
+			if !reflect.DeepEqual(actualConflicts, tt.conflicts) {
+				t.Errorf("conflicts: %v, expected: %v", actualConflicts, tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestPlanUsersMatchConflicts(t *testing.T) {
+	var tests = []struct {
+		name        string
+		users       []*User
+		keeperUsers []map[string]any
+		expected    []string
+	}{
+		{
+			name: "renamed Google user",
+			users: []*User{
+				{Id: "u1", Email: "alice@company.com", FullName: "alice.old@company.com", Active: true},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "alice.old@company.com", "u1"),
+			},
+			expected: []string{"update PATCH k1"},
+		},
+		{
+			name: "new username belongs to another Keeper user",
+			users: []*User{
+				{Id: "u1", Email: "alice@company.com", FullName: "alice.old@company.com", Active: true},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "alice.old@company.com", "u1"),
+				scimUserObject("k2", "alice@company.com", ""),
+			},
+			expected: []string{"update PATCH k1 (skipped)"},
+		},
+		{
+			name: "Keeper users sharing an external ID",
+			users: []*User{
+				{Id: "u1", Email: "alice@company.com", FullName: "Alice", Active: true},
+			},
+			keeperUsers: []map[string]any{
+				scimUserObject("k1", "alice.old@company.com", "u1"),
+				scimUserObject("k2", "alice@company.com", "u1"),
+			},
+			expected: []string{"update PATCH alice@company.com (skipped)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s = newTestSync(t, &testSource{users: tt.users}, newTestScim(tt.keeperUsers, nil))
+			s.destructive = 1
+			var plan = new(SyncPlan)
+			if err := s.planUsers(plan); err != nil {
+				t.Fatal(err)
+			}
+			if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("operations:\n%s\nexpected:\n%s", strings.Join(actual, "\n"), strings.Join(tt.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestMatchGroups(t *testing.T) {
+	var tests = []struct {
+		name      string
+		groups    []*Group
+		teams     []*scimGroup
+		matches   map[string]string
+		conflicts []string
+	}{
+		{
+			name:   "external ID takes precedence over name",
+			groups: []*Group{{Id: "g1", Name: "Engineering"}},
+			teams: []*scimGroup{
+				{Group: Group{Id: "t1", Name: "Engineering"}},
+				{Group: Group{Id: "t2", Name: "Developers"}, ExternalId: "g1"},
+			},
+			matches: map[string]string{"g1": "t2"},
+		},
+		{
+			name:   "name match is case insensitive",
+			groups: []*Group{{Id: "g1", Name: "Engineering"}},
+			teams: []*scimGroup{
+				{Group: Group{Id: "t1", Name: "ENGINEERING"}},
+			},
+			matches: map[string]string{"g1": "t1"},
+		},
+		{
+			name:   "teams sharing an external ID",
+			groups: []*Group{{Id: "g1", Name: "Engineering"}},
+			teams: []*scimGroup{
+				{Group: Group{Id: "t2", Name: "Engineering"}, ExternalId: "g1"},
+				{Group: Group{Id: "t1", Name: "Developers"}, ExternalId: "g1"},
+			},
+			matches:   map[string]string{},
+			conflicts: []string{"g1: t1,t2"},
+		},
+		{
+			name: "groups sharing a name",
+			groups: []*Group{
+				{Id: "g2", Name: "Engineering"},
+				{Id: "g1", Name: "engineering"},
+			},
+			teams: []*scimGroup{
+				{Group: Group{Id: "t1", Name: "Engineering"}},
+			},
+			matches:   map[string]string{},
+			conflicts: []string{"g1: t1", "g2: t1"},
+		},
+		{
+			name:   "team linked to another group",
+			groups: []*Group{{Id: "g1", Name: "Engineering"}},
+			teams: []*scimGroup{
+				{Group: Group{Id: "t1", Name: "Engineering"}, ExternalId: "g9"},
+			},
+			matches:   map[string]string{},
+			conflicts: []string{"g1: t1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s = &sync{}
+			var externalGroups = make(map[string]*Group)
+			for _, group := range tt.groups {
+				externalGroups[group.Id] = group
+			}
+			var keeperGroups = make(map[string]*scimGroup)
+			for _, team := range tt.teams {
+				keeperGroups[team.Id] = team
+			}
+			var matches, conflicts = s.matchGroups(externalGroups, keeperGroups)
+			var actual = make(map[string]string)
+			for groupId, team := range matches {
+				actual[groupId] = team.Id
+			}
+			if !reflect.DeepEqual(actual, tt.matches) {
+				t.Errorf("matches: %v, expected: %v", actual, tt.matches)
+			}
+			var actualConflicts []string
+			for _, conflict := range conflicts {
+				var ids []string
+				for _, team := range conflict.teams {
+					ids = append(ids, team.Id)
+				}
+				actualConflicts = append(actualConflicts, fmt.Sprintf("%s: %s", conflict.group.Id, strings.Join(ids, ",")))
+			}
+			if !reflect.DeepEqual(actualConflicts, tt.conflicts) {
+				t.Errorf("conflicts: %v, expected: %v", actualConflicts, tt.conflicts)
+			}
+		})
+	}
+}
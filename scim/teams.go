@@ -0,0 +1,279 @@
+package scim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/text/cases"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// mappedTeamPrefix prefixes external IDs of Keeper teams fed by the team mapping
+const mappedTeamPrefix = "team:"
+
+// ParseTeamMapping parses the "SCIM Team Mapping" content
+// One "<Google group email or name> => <Keeper team name>" per line. Several Google groups may feed one Keeper team
+func ParseTeamMapping(value string) (mapping map[string]string, err error) {
+	mapping = make(map[string]string)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var group, team, ok = strings.Cut(line, "=>")
+		if !ok {
+			err = fmt.Errorf("invalid team mapping \"%s\": expected \"<Google group> => <Keeper team>\"", line)
+			return
+		}
+		if err = addTeamMapping(mapping, group, team); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ParseTeamMappingFile parses a team mapping file attached to the SCIM record
+// The file is either a JSON object or a flat YAML mapping of Google group email or name to Keeper team name
+func ParseTeamMappingFile(fileName string, data []byte) (mapping map[string]string, err error) {
+	mapping = make(map[string]string)
+	var lowerName = strings.ToLower(fileName)
+	if strings.HasSuffix(lowerName, ".yaml") || strings.HasSuffix(lowerName, ".yml") {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimRight(line, "\r")
+			var trimmed = strings.TrimSpace(line)
+			if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+				continue
+			}
+			var group, team string
+			if group, team, err = splitYamlPair(trimmed); err != nil {
+				err = fmt.Errorf("team mapping file \"%s\": %s", fileName, err.Error())
+				return
+			}
+			if err = addTeamMapping(mapping, group, team); err != nil {
+				return
+			}
+		}
+		return
+	}
+	var jo map[string]string
+	if err = json.Unmarshal(data, &jo); err != nil {
+		err = fmt.Errorf("team mapping file \"%s\": %s", fileName, err.Error())
+		return
+	}
+	for group, team := range jo {
+		if err = addTeamMapping(mapping, group, team); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// splitYamlPair splits a "key: value" YAML line. Keys and values may be quoted.
+// A " #" outside of quotes starts a comment
+func splitYamlPair(line string) (key string, value string, err error) {
+	var rest string
+	if strings.HasPrefix(line, "\"") || strings.HasPrefix(line, "'") {
+		var pos = strings.Index(line[1:], line[:1])
+		if pos < 0 {
+			err = fmt.Errorf("unterminated quote in \"%s\"", line)
+			return
+		}
+		key = line[1 : pos+1]
+		rest = strings.TrimSpace(line[pos+2:])
+		if !strings.HasPrefix(rest, ":") {
+			err = fmt.Errorf("expected \"key: value\" in \"%s\"", line)
+			return
+		}
+		rest = rest[1:]
+	} else {
+		var ok bool
+		if key, rest, ok = strings.Cut(line, ": "); !ok {
+			err = fmt.Errorf("expected \"key: value\" in \"%s\"", line)
+			return
+		}
+	}
+	value = strings.TrimSpace(rest)
+	if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+		var pos = strings.IndexByte(value[1:], value[0])
+		if pos < 0 {
+			err = fmt.Errorf("unterminated quote in \"%s\"", line)
+			return
+		}
+		if tail := strings.TrimSpace(value[pos+2:]); len(tail) > 0 && !strings.HasPrefix(tail, "#") {
+			err = fmt.Errorf("unexpected \"%s\" after the quoted value in \"%s\"", tail, line)
+			return
+		}
+		value = value[1 : pos+1]
+	} else if strings.HasPrefix(value, "#") {
+		value = ""
+	} else if pos := strings.Index(value, " #"); pos >= 0 {
+		value = strings.TrimSpace(value[:pos])
+	}
+	return
+}
+
+func addTeamMapping(mapping map[string]string, group string, team string) error {
+	group = strings.TrimSpace(group)
+	team = strings.TrimSpace(team)
+	if len(group) == 0 || len(team) == 0 {
+		return fmt.Errorf("invalid team mapping \"%s\" => \"%s\": Google group and Keeper team cannot be empty", group, team)
+	}
+	var key = cases.Fold().String(group)
+	if existing, ok := mapping[key]; ok && existing != team {
+		return fmt.Errorf("invalid team mapping: Google group \"%s\" is mapped to both \"%s\" and \"%s\"", group, existing, team)
+	}
+	mapping[key] = team
+	return nil
+}
+
+// ParseTeamNameTemplate parses the "Team Name Template" content, e.g. "GWS - {{.Name}}"
+// The template receives the Google group: {{.Name}}, {{.Email}} and {{.Id}}
+func ParseTeamNameTemplate(value string) (tmpl *template.Template, err error) {
+	if tmpl, err = template.New("team").Option("missingkey=error").Parse(value); err != nil {
+		return
+	}
+	var name string
+	if name, err = executeTeamNameTemplate(tmpl, &Group{Id: "id", Name: "name", Email: "email"}); err == nil && len(name) == 0 {
+		err = fmt.Errorf("template \"%s\" produces an empty team name", value)
+	}
+	return
+}
+
+func executeTeamNameTemplate(tmpl *template.Template, group *Group) (name string, err error) {
+	var buffer bytes.Buffer
+	if err = tmpl.Execute(&buffer, group); err == nil {
+		name = sanitizeTeamName(buffer.String())
+	}
+	return
+}
+
+// sanitizeTeamName removes control characters and markup characters from a team name and collapses whitespace
+func sanitizeTeamName(name string) string {
+	var result = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case !unicode.IsPrint(r), strings.ContainsRune("<>", r):
+			return -1
+		}
+		return r
+	}, name)
+	return strings.Join(strings.Fields(result), " ")
+}
+
+// teamNamespace returns the prefix and suffix the team name template puts around Google group data
+func teamNamespace(tmpl *template.Template) (prefix string, suffix string) {
+	if tmpl == nil {
+		return
+	}
+	const marker = "\u2063"
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, &Group{Id: marker, Name: marker, Email: marker}); err != nil {
+		return
+	}
+	var name = buffer.String()
+	var first = strings.Index(name, marker)
+	if first < 0 {
+		return
+	}
+	prefix = sanitizeTeamName(name[:first])
+	suffix = sanitizeTeamName(name[strings.LastIndex(name, marker)+len(marker):])
+	return
+}
+
+// isManagedTeamName checks if a Keeper team name belongs to the namespace of the team name template
+func (s *sync) isManagedTeamName(name string) bool {
+	var prefix, suffix = teamNamespace(s.teamNameTemplate)
+	if len(prefix) == 0 && len(suffix) == 0 {
+		return true
+	}
+	var fold = cases.Fold()
+	name = fold.String(name)
+	prefix = fold.String(prefix)
+	suffix = fold.String(suffix)
+	return len(name) > len(prefix)+len(suffix) && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix)
+}
+
+// teamName returns the Keeper team name for a Google group that is not mapped explicitly
+func (s *sync) teamName(group *Group) string {
+	if s.teamNameTemplate != nil {
+		var name, err = executeTeamNameTemplate(s.teamNameTemplate, group)
+		if err == nil && len(name) > 0 {
+			return name
+		}
+		s.debugLogger(fmt.Sprintf("Team name template cannot be applied to Google group \"%s\"", group.Name))
+	}
+	return sanitizeTeamName(group.Name)
+}
+
+// buildTeams converts Google groups to Keeper teams according to the team mapping
+// A Google group that is not mapped feeds a team named after the team name template with the group ID as external ID
+// Google groups covered by "SCIM Exclude" do not feed any team
+func (s *sync) buildTeams() {
+	s.teams = make(map[string]*Group)
+	s.groupTeams = make(map[string]string)
+	s.teamSources = make(map[string][]string)
+	s.excludedGroups = make(map[string]*excludedResource)
+	var fold = cases.Fold()
+	s.source.Groups(func(group *Group) {
+		var mappedName, mapped = s.teamMapping[fold.String(group.Email)]
+		if !mapped {
+			mappedName, mapped = s.teamMapping[fold.String(group.Name)]
+		}
+		var teamName string
+		if mapped {
+			teamName = sanitizeTeamName(mappedName)
+		} else {
+			teamName = s.teamName(group)
+		}
+		if entry := s.exclusionOf(group.Email, group.Name, teamName); len(entry) > 0 {
+			s.excludedGroups[group.Id] = &excludedResource{
+				name:  group.Name,
+				entry: entry,
+			}
+			return
+		}
+		var team *Group
+		if mapped {
+			var ok bool
+			var teamId = mappedTeamPrefix + fold.String(mappedName)
+			if team, ok = s.teams[teamId]; !ok {
+				team = &Group{
+					Id:   teamId,
+					Name: teamName,
+				}
+				s.teams[teamId] = team
+			}
+			s.teamSources[teamId] = append(s.teamSources[teamId], group.Id)
+		} else {
+			team = &Group{
+				Id:    group.Id,
+				Name:  teamName,
+				Email: group.Email,
+			}
+			s.teams[team.Id] = team
+		}
+		s.groupTeams[group.Id] = team.Id
+	})
+}
+
+// userTeams returns IDs of the teams a Google user is a member of
+func (s *sync) userTeams(user *User) (teamIds []string) {
+	var teams = NewSet[string]()
+	for _, groupId := range user.Groups {
+		if _, ok := s.excludedGroups[groupId]; ok {
+			continue
+		}
+		var teamId, ok = s.groupTeams[groupId]
+		if !ok {
+			teamId = groupId
+		}
+		if !teams.Has(teamId) {
+			teams.Add(teamId)
+			teamIds = append(teamIds, teamId)
+		}
+	}
+	return
+}
@@ -0,0 +1,178 @@
+package scim
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitYamlPair(t *testing.T) {
+	var tests = []struct {
+		line    string
+		key     string
+		value   string
+		invalid bool
+	}{
+		{line: "sales@company.com: Sales", key: "sales@company.com", value: "Sales"},
+		{line: "sales@company.com: Sales Team # west coast", key: "sales@company.com", value: "Sales Team"},
+		{line: "sales@company.com: Sales#1", key: "sales@company.com", value: "Sales#1"},
+		{line: "sales@company.com: # no team", key: "sales@company.com", value: ""},
+		{line: "\"Sales: West\": \"Sales # West\"", key: "Sales: West", value: "Sales # West"},
+		{line: "'Support' : 'Help Desk' # comment", key: "Support", value: "Help Desk"},
+		{line: "Engineering: R&D: Core", key: "Engineering", value: "R&D: Core"},
+		{line: "Engineering:R&D", invalid: true},
+		{line: "Engineering", invalid: true},
+		{line: "\"Engineering: R&D", invalid: true},
+		{line: "\"Engineering\" R&D", invalid: true},
+		{line: "Engineering: \"R&D", invalid: true},
+		{line: "Engineering: \"R&D\" Core", invalid: true},
+	}
+	for _, tt := range tests {
+		var key, value, err = splitYamlPair(tt.line)
+		if invalid := err != nil; invalid != tt.invalid {
+			t.Errorf("%s: error %v", tt.line, err)
+		} else if err == nil && (key != tt.key || value != tt.value) {
+			t.Errorf("%s: \"%s\" => \"%s\", expected \"%s\" => \"%s\"", tt.line, key, value, tt.key, tt.value)
+		}
+	}
+}
+
+func TestParseTeamMapping(t *testing.T) {
+	var expected = map[string]string{
+		"sales@company.com": "Sales",
+		"sales west":        "Sales",
+		"support":           "Help Desk",
+	}
+	var mapping, err = ParseTeamMapping(`
+# comment
+Sales@Company.com => Sales
+Sales West => Sales
+Support => Help Desk
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mapping, expected) {
+		t.Errorf("mapping: %v", mapping)
+	}
+	for _, value := range []string{"Sales", "Sales =>", "=> Sales", "Sales => A\nsales => B"} {
+		if _, err = ParseTeamMapping(value); err == nil {
+			t.Errorf("\"%s\" is accepted", value)
+		}
+	}
+
+	if mapping, err = ParseTeamMappingFile("mapping.yaml", []byte("---\r\n# comment\r\nSales@Company.com: Sales\r\n\"Sales West\": Sales # merged\nsupport: 'Help Desk'\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mapping, expected) {
+		t.Errorf("YAML mapping: %v", mapping)
+	}
+	if mapping, err = ParseTeamMappingFile("mapping.json", []byte(`{"Sales@Company.com": "Sales", "Sales West": "Sales", "Support": "Help Desk"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mapping, expected) {
+		t.Errorf("JSON mapping: %v", mapping)
+	}
+	if _, err = ParseTeamMappingFile("mapping.yml", []byte("Sales: # no team\n")); err == nil {
+		t.Error("empty team is accepted")
+	}
+	if _, err = ParseTeamMappingFile("mapping.json", []byte("Sales: Sales")); err == nil {
+		t.Error("invalid JSON is accepted")
+	}
+}
+
+func TestMappedTeams(t *testing.T) {
+	var s = &sync{source: &testSource{
+		groups: []*Group{
+			{Id: "g1", Name: "Sales East", Email: "east@company.com"},
+			{Id: "g2", Name: "Sales West", Email: "west@company.com"},
+			{Id: "g3", Name: "Support", Email: "support@company.com"},
+		},
+		users: []*User{},
+	}}
+	s.SetTeamMapping(map[string]string{"East@Company.com": "Sales", "sales west": "Sales"})
+	s.buildTeams()
+	var teamId = mappedTeamPrefix + "sales"
+	if team, ok := s.teams[teamId]; !ok || team.Name != "Sales" {
+		t.Fatalf("teams: %v", s.teams)
+	}
+	if expected := []string{"g1", "g2"}; !reflect.DeepEqual(s.teamSources[teamId], expected) {
+		t.Errorf("team sources: %v", s.teamSources[teamId])
+	}
+	var user = &User{Id: "u1", Groups: []string{"g2", "g3", "g1"}}
+	if teams := s.userTeams(user); !reflect.DeepEqual(teams, []string{teamId, "g3"}) {
+		t.Errorf("user teams: %v", teams)
+	}
+}
+
+func TestTeamNameTemplate(t *testing.T) {
+	var tmpl, err = ParseTeamNameTemplate("GWS - {{.Name}} <{{.Email}}>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s = &sync{teamNameTemplate: tmpl}
+	if name := s.teamName(&Group{Name: "Sales\tWest ", Email: "west@company.com"}); name != "GWS - Sales West west@company.com" {
+		t.Errorf("team name: \"%s\"", name)
+	}
+	var prefix, suffix = teamNamespace(tmpl)
+	if prefix != "GWS -" || suffix != "" {
+		t.Errorf("namespace: \"%s\", \"%s\"", prefix, suffix)
+	}
+	var tests = []struct {
+		name    string
+		managed bool
+	}{
+		{name: "GWS - Sales", managed: true},
+		{name: "gws - sales", managed: true},
+		{name: "GWS -", managed: false},
+		{name: "Sales", managed: false},
+	}
+	for _, tt := range tests {
+		if managed := s.isManagedTeamName(tt.name); managed != tt.managed {
+			t.Errorf("\"%s\": managed %t", tt.name, managed)
+		}
+	}
+	if !(&sync{}).isManagedTeamName("Sales") {
+		t.Error("any team is managed without the template")
+	}
+	for _, value := range []string{"{{.Name", "{{.Missing}}", "{{if false}}x{{end}}"} {
+		if _, err = ParseTeamNameTemplate(value); err == nil {
+			t.Errorf("\"%s\" is accepted", value)
+		}
+	}
+}
+
+func TestTeamsOutsideNamespace(t *testing.T) {
+	var tmpl, _ = ParseTeamNameTemplate("GWS - {{.Name}}")
+	var teams = []map[string]any{
+		scimGroupObject("t1", "GWS - Sales", "g1"),
+		scimGroupObject("t2", "GWS - Support", ""),
+		scimGroupObject("t3", "Hand Made", ""),
+		scimGroupObject("t4", "Old Name", "g4"),
+	}
+	var source = &testSource{users: []*User{{Id: "u1", Email: "alice@company.com", FullName: "alice@company.com", Active: true}}}
+	var s = newTestSync(t, source, newTestScim([]map[string]any{
+		scimUserObject("k1", "alice@company.com", "u1", "t1", "t2", "t3", "t4"),
+	}, teams))
+	s.SetTeamNameTemplate(tmpl)
+	s.SetDestructive(1)
+	s.SetVerbose(true)
+	var plan = new(SyncPlan)
+	if err := s.planGroups(plan); err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{"delete DELETE t1", "delete DELETE t2", "delete DELETE t3 (skipped)", "delete DELETE t4"}
+	if actual := describeOperations(plan.Operations); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("groups: %v, expected: %v", actual, expected)
+	}
+	plan = new(SyncPlan)
+	if err := s.planMembership(plan); err != nil {
+		t.Fatal(err)
+	}
+	var payloads []string
+	for _, op := range plan.Operations {
+		payloads = append(payloads, describeMembership(op.Payload))
+	}
+	if expected := []string{"", "remove t1,t2,t4"}; !reflect.DeepEqual(payloads, expected) {
+		t.Errorf("membership: %q, expected: %q", payloads, expected)
+	}
+}
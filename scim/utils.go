@@ -1,8 +1,11 @@
 package scim
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func ParseScimGroups(fields []map[string]any) (groups []string) {
@@ -29,6 +32,64 @@ func ParseScimGroups(fields []map[string]any) (groups []string) {
 	return
 }
 
+// ParseDeletionLimit parses the "Deletion Limit" value
+// The value is a comma-separated list of an absolute count and/or percentage, e.g. "50, 10%"
+func ParseDeletionLimit(value string) (count int32, percent int32, err error) {
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		var isPercent = strings.HasSuffix(v, "%")
+		var iv int
+		if iv, err = strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(v, "%"))); err != nil || iv < 0 {
+			err = fmt.Errorf("invalid deletion limit \"%s\"", v)
+			return
+		}
+		if isPercent {
+			percent = int32(iv)
+		} else {
+			count = int32(iv)
+		}
+	}
+	return
+}
+
+// parseDuration parses Go duration strings with an additional "d" (days) unit
+// A plain number is interpreted in the given unit. Zero unit requires an explicit unit
+func parseDuration(value string, unit time.Duration) (result time.Duration, err error) {
+	value = strings.TrimSpace(value)
+	var iv int
+	if iv, err = strconv.Atoi(value); err == nil {
+		if unit <= 0 {
+			err = fmt.Errorf("duration \"%s\" requires a unit, e.g. \"%sd\" or \"%sh\"", value, value, value)
+			return
+		}
+		result = time.Duration(iv) * unit
+	} else if strings.HasSuffix(value, "d") {
+		if iv, err = strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+			result = time.Duration(iv) * 24 * time.Hour
+		}
+	} else {
+		result, err = time.ParseDuration(value)
+	}
+	if err == nil && result < 0 {
+		err = fmt.Errorf("negative duration \"%s\"", value)
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid duration \"%s\"", value)
+	}
+	return
+}
+
+func sortedKeys[V any](m map[string]V) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
 func toBoolean(intf any) (result bool, ok bool) {
 	if intf == nil {
 		return
@@ -0,0 +1,62 @@
+package scim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDeletionLimit(t *testing.T) {
+	var tests = []struct {
+		value   string
+		count   int32
+		percent int32
+		invalid bool
+	}{
+		{value: ""},
+		{value: "50", count: 50},
+		{value: "10%", percent: 10},
+		{value: " 50 , 10 % ", count: 50, percent: 10},
+		{value: "10%, 50", count: 50, percent: 10},
+		{value: "-1", invalid: true},
+		{value: "ten", invalid: true},
+		{value: "%", invalid: true},
+	}
+	for _, tt := range tests {
+		var count, percent, err = ParseDeletionLimit(tt.value)
+		if invalid := err != nil; invalid != tt.invalid {
+			t.Errorf("\"%s\": error %v", tt.value, err)
+			continue
+		}
+		if count != tt.count || percent != tt.percent {
+			t.Errorf("\"%s\": %d, %d%%, expected %d, %d%%", tt.value, count, percent, tt.count, tt.percent)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	var tests = []struct {
+		value    string
+		unit     time.Duration
+		expected time.Duration
+		invalid  bool
+	}{
+		{value: "7d", expected: 7 * 24 * time.Hour},
+		{value: "36h", expected: 36 * time.Hour},
+		{value: "1h30m", expected: 90 * time.Minute},
+		{value: " 2d ", expected: 48 * time.Hour},
+		{value: "3", unit: 24 * time.Hour, expected: 72 * time.Hour},
+		{value: "3", invalid: true},
+		{value: "-1d", invalid: true},
+		{value: "-2h", invalid: true},
+		{value: "xd", invalid: true},
+		{value: "week", invalid: true},
+	}
+	for _, tt := range tests {
+		var actual, err = parseDuration(tt.value, tt.unit)
+		if invalid := err != nil; invalid != tt.invalid {
+			t.Errorf("\"%s\": error %v", tt.value, err)
+		} else if err == nil && actual != tt.expected {
+			t.Errorf("\"%s\": %s, expected %s", tt.value, actual, tt.expected)
+		}
+	}
+}